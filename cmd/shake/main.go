@@ -1,85 +1,152 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
 
 	"github.com/mibar/tree-shaker/pkg/shaker"
 )
 
 const usage = `usage: shake [include|exclude] [flags] <path> [path...]
+       shake version
 
 Mode defaults to "include" if omitted.
 
+Paths may also be read from -query-file, one per line; blank lines and
+lines starting with # are ignored. They are combined with any paths
+given as arguments.
+
 Input sources (first match wins):
-  -file <path>    Read from file
+  -file <path>    Read from file (repeatable)
   -input <json>   Read from argument
   (default)       Read from stdin
 
+With several -file inputs (or -output-dir), each file is shaken on its own
+and written to <name>.shaken.json next to it, or in -output-dir. Errors
+name the file; -keep-going carries on with the remaining files.
+
+Use -check to list the input if shaking would change it, without writing
+any output; the exit status is 1 when it would change.
+
+Use -i with -file to overwrite the file(s) in place. Files whose content
+would not change are left untouched.
+
 Examples:
   shake '$.api_version'
   shake -file data.json -pretty '$.name' '$.email'
+  shake exclude -query-file denylist.txt -file data.json
   curl -s url | shake '$.data[*].id'
-  kubectl get pods -o json | shake exclude '$..managedFields'`
+  kubectl get pods -o json | shake exclude '$..managedFields'
+  shake exclude -check -file config.json '$..password'
+  shake exclude -i -file config.json '$..password'
+  shake exclude -file a.json -file b.json -output-dir out '$..token'`
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Fprintln(os.Stderr, usage)
-		os.Exit(1)
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run is the whole command minus the process: it parses args, reads input
+// from the named files or stdin, and returns the exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) < 1 {
+		fmt.Fprintln(stderr, usage)
+		return 1
+	}
+
+	if args[0] == "version" {
+		printVersion(stdout)
+		return 0
 	}
 
 	// Default to include; consume mode arg only if explicitly provided.
 	mode := "include"
-	flagArgs := os.Args[1:]
-	if os.Args[1] == "include" || os.Args[1] == "exclude" {
-		mode = os.Args[1]
-		flagArgs = os.Args[2:]
+	flagArgs := args
+	if args[0] == "include" || args[0] == "exclude" {
+		mode = args[0]
+		flagArgs = args[1:]
 	}
 
-	fs := flag.NewFlagSet("shake", flag.ExitOnError)
-	file := fs.String("file", "", "path to input JSON file")
+	fs := flag.NewFlagSet("shake", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	var files fileList
+	fs.Var(&files, "file", "path to input JSON file (repeatable)")
 	input := fs.String("input", "", "inline JSON string")
 	output := fs.String("output", "", "path to output JSON file (default: stdout)")
 	maxDepth := fs.Int("max-depth", 0, fmt.Sprintf("maximum JSON nesting depth (default: %d, -1 = no limit)", shaker.MaxDepth))
 	maxPathLength := fs.Int("max-path-length", 0, fmt.Sprintf("maximum byte length per JSONPath expression (default: %d, -1 = no limit)", shaker.MaxPathLength))
 	maxPathCount := fs.Int("max-path-count", 0, fmt.Sprintf("maximum number of JSONPath expressions (default: %d, -1 = no limit)", shaker.MaxPathCount))
 	pretty := fs.Bool("pretty", false, "pretty-print the JSON output")
-	fs.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
-	fs.Parse(flagArgs)
+	check := fs.Bool("check", false, "report whether the input would change instead of writing output")
+	inPlace := fs.Bool("i", false, "edit the -file input in place")
+	queryFile := fs.String("query-file", "", "path to a file of JSONPath expressions, one per line")
+	outputDir := fs.String("output-dir", "", "directory for per-file results (default: next to each input)")
+	keepGoing := fs.Bool("keep-going", false, "with several -file inputs, continue after a file fails")
+	version := fs.Bool("version", false, "print version information and exit")
+	fs.Usage = func() { fmt.Fprintln(stderr, usage) }
+	if err := fs.Parse(flagArgs); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
 
-	paths := fs.Args()
-	if len(paths) == 0 {
-		fmt.Fprintln(os.Stderr, "error: at least one JSONPath expression is required")
-		fmt.Fprintln(os.Stderr, usage)
-		os.Exit(1)
+	if *version {
+		printVersion(stdout)
+		return 0
 	}
 
-	var data []byte
-	switch {
-	case *file != "":
-		f, err := os.Open(*file)
+	paths := fs.Args()
+	if *queryFile != "" {
+		filePaths, err := readQueryFile(*queryFile)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "open file: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(stderr, "read query file: %v\n", err)
+			return 1
 		}
-		defer f.Close()
-		data, err = io.ReadAll(f)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "read file: %v\n", err)
-			os.Exit(1)
+		paths = append(filePaths, paths...)
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(stderr, "error: at least one JSONPath expression is required")
+		fmt.Fprintln(stderr, usage)
+		return 1
+	}
+
+	batch := len(files) > 1 || *outputDir != ""
+
+	if *check && *output != "" {
+		fmt.Fprintln(stderr, "error: -check cannot be combined with -output")
+		return 1
+	}
+	if batch {
+		switch {
+		case len(files) == 0:
+			fmt.Fprintln(stderr, "error: -output-dir requires -file")
+			return 1
+		case *output != "":
+			fmt.Fprintln(stderr, "error: -output cannot be combined with several -file inputs; use -output-dir")
+			return 1
+		case *outputDir != "" && (*check || *inPlace):
+			fmt.Fprintln(stderr, "error: -output-dir cannot be combined with -check or -i")
+			return 1
 		}
-	case *input != "":
-		data = []byte(*input)
-	default:
-		var err error
-		data, err = io.ReadAll(os.Stdin)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "read stdin: %v\n", err)
-			os.Exit(1)
+	}
+	if *inPlace {
+		switch {
+		case len(files) == 0:
+			fmt.Fprintln(stderr, "error: -i requires -file")
+			return 1
+		case *output != "":
+			fmt.Fprintln(stderr, "error: -i cannot be combined with -output")
+			return 1
+		case *check:
+			fmt.Fprintln(stderr, "error: -i cannot be combined with -check")
+			return 1
 		}
 	}
 
@@ -109,27 +176,296 @@ func main() {
 	}
 	q = q.WithLimits(limits)
 
-	out, err := shaker.Shake(data, q)
+	var opts []shaker.ShakeOption
+	if *pretty {
+		opts = append(opts, shaker.WithIndent("", "  "))
+	}
+
+	// Compile once up front: errors surface before any file is touched and
+	// every input reuses the same trie.
+	q, err := q.Compile()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "shake: %v\n", err)
-		os.Exit(1)
+		fmt.Fprintf(stderr, "shake: %v\n", err)
+		return 1
 	}
 
-	if *pretty {
-		var buf bytes.Buffer
-		if err := json.Indent(&buf, out, "", "  "); err != nil {
-			fmt.Fprintf(os.Stderr, "pretty-print: %v\n", err)
-			os.Exit(1)
+	if batch {
+		b := batchRun{
+			q:         q,
+			opts:      opts,
+			check:     *check,
+			inPlace:   *inPlace,
+			outputDir: *outputDir,
+			keepGoing: *keepGoing,
+			stdout:    stdout,
+			stderr:    stderr,
+		}
+		if !b.run(files) {
+			return 1
 		}
-		out = buf.Bytes()
+		return 0
+	}
+
+	var file string
+	if len(files) == 1 {
+		file = files[0]
+	}
+
+	var data []byte
+	switch {
+	case file != "":
+		data, err = os.ReadFile(file)
+		if err != nil {
+			fmt.Fprintf(stderr, "read file: %v\n", err)
+			return 1
+		}
+	case *input != "":
+		data = []byte(*input)
+	default:
+		data, err = io.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintf(stderr, "read stdin: %v\n", err)
+			return 1
+		}
+	}
+
+	out, changed, err := shaker.ShakeChanged(data, q, opts...)
+	if err != nil {
+		fmt.Fprintf(stderr, "shake: %v\n", err)
+		return 1
+	}
+
+	if *check {
+		if changed {
+			fmt.Fprintln(stdout, sourceName(file, *input))
+			return 1
+		}
+		return 0
+	}
+
+	if *inPlace {
+		if !changed {
+			return 0
+		}
+		if err := writeFileAtomic(file, append(out, '\n')); err != nil {
+			fmt.Fprintf(stderr, "write file: %v\n", err)
+			return 1
+		}
+		return 0
 	}
 
 	if *output != "" {
 		if err := os.WriteFile(*output, append(out, '\n'), 0o644); err != nil {
-			fmt.Fprintf(os.Stderr, "write output: %v\n", err)
-			os.Exit(1)
+			fmt.Fprintf(stderr, "write output: %v\n", err)
+			return 1
 		}
 	} else {
-		fmt.Println(string(out))
+		fmt.Fprintln(stdout, string(out))
+	}
+	return 0
+}
+
+// fileList collects the values of a repeatable flag.
+type fileList []string
+
+func (l *fileList) String() string { return strings.Join(*l, ",") }
+
+func (l *fileList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// batchRun shakes several files independently with one compiled query.
+type batchRun struct {
+	q         shaker.Query
+	opts      []shaker.ShakeOption
+	check     bool
+	inPlace   bool
+	outputDir string
+	keepGoing bool
+	stdout    io.Writer
+	stderr    io.Writer
+}
+
+// run processes files in order and reports whether all of them succeeded
+// (and, with -check, none would change). Failures are reported per file.
+func (b batchRun) run(files []string) bool {
+	if !b.check && !b.inPlace {
+		if err := checkOutputs(files, b.outputDir); err != nil {
+			fmt.Fprintf(b.stderr, "error: %v\n", err)
+			return false
+		}
+	}
+
+	ok := true
+	for _, name := range files {
+		changed, err := b.file(name)
+		if err != nil {
+			fmt.Fprintf(b.stderr, "%s: %v\n", name, err)
+			ok = false
+			if !b.keepGoing {
+				return false
+			}
+			continue
+		}
+		if b.check && changed {
+			fmt.Fprintln(b.stdout, name)
+			ok = false
+		}
+	}
+	return ok
+}
+
+func (b batchRun) file(name string) (changed bool, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+
+	out, changed, err := shaker.ShakeChanged(data, b.q, b.opts...)
+	if err != nil {
+		return false, err
+	}
+	out = append(out, '\n')
+
+	switch {
+	case b.check:
+		return changed, nil
+	case b.inPlace:
+		if !changed {
+			return false, nil
+		}
+		return true, writeFileAtomic(name, out)
+	default:
+		return changed, os.WriteFile(shakenPath(name, b.outputDir), out, 0o644)
+	}
+}
+
+// shakenPath names the batch output for input: <name>.shaken.json, next to
+// the input or in dir when set.
+func shakenPath(input, dir string) string {
+	base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input)) + ".shaken.json"
+	if dir == "" {
+		dir = filepath.Dir(input)
+	}
+	return filepath.Join(dir, base)
+}
+
+// checkOutputs reports an error when two inputs map to the same
+// <name>.shaken.json, as x/a.json and y/a.json do under -output-dir, or when
+// an output would overwrite one of the inputs. It runs before any file is
+// written, so a clash never leaves a partial batch behind.
+func checkOutputs(files []string, dir string) error {
+	inputs := make(map[string]bool, len(files))
+	for _, name := range files {
+		inputs[filepath.Clean(name)] = true
+	}
+
+	outputs := make(map[string]string, len(files))
+	for _, name := range files {
+		out := shakenPath(name, dir)
+		if prev, ok := outputs[out]; ok {
+			return fmt.Errorf("%s and %s would both be written to %s", prev, name, out)
+		}
+		if inputs[out] {
+			return fmt.Errorf("output for %s would overwrite input %s", name, out)
+		}
+		outputs[out] = name
+	}
+	return nil
+}
+
+// sourceName names the input in -check output, like gofmt -l does.
+func sourceName(file, input string) string {
+	switch {
+	case file != "":
+		return file
+	case input != "":
+		return "<input>"
+	default:
+		return "<stdin>"
+	}
+}
+
+// readQueryFile returns the JSONPath expressions listed in path, one per
+// line, skipping blank lines and # comments.
+func readQueryFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, sc.Err()
+}
+
+// writeFileAtomic replaces path with data via a temporary file in the same
+// directory, so readers never observe a partially written file. The
+// original file mode is preserved. A symlink is followed and its target
+// replaced, leaving the link itself in place.
+func writeFileAtomic(path string, data []byte) error {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// printVersion reports the module version and Go toolchain, plus the VCS
+// commit when the binary was built from a checkout.
+func printVersion(w io.Writer) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(w, "shake (unknown version)")
+		return
+	}
+
+	fmt.Fprintf(w, "shake %s %s", info.Main.Version, info.GoVersion)
+
+	var revision, dirty string
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			if s.Value == "true" {
+				dirty = "-dirty"
+			}
+		}
+	}
+	if revision != "" {
+		fmt.Fprintf(w, " commit %s%s", revision, dirty)
 	}
+	fmt.Fprintln(w)
 }
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// shake runs the command with args and stdin and returns its exit status
+// and output.
+func shake(t *testing.T, stdin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	code = run(args, strings.NewReader(stdin), &out, &errOut)
+	return code, out.String(), errOut.String()
+}
+
+// writeFiles creates each name → content pair under dir and returns the
+// paths in argument order.
+func writeFiles(t *testing.T, dir string, files ...string) []string {
+	t.Helper()
+	var paths []string
+	for i := 0; i+1 < len(files); i += 2 {
+		p := filepath.Join(dir, files[i])
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(files[i+1]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRunStdin(t *testing.T) {
+	code, out, errOut := shake(t, `{"a":1,"b":2}`, "exclude", "$.b")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if out != "{\"a\":1}\n" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"exclude"}} {
+		code, out, errOut := shake(t, `{}`, args...)
+		if code != 1 || out != "" || !strings.Contains(errOut, "usage: shake") {
+			t.Errorf("%q: got exit %d, stdout %q, stderr %q", args, code, out, errOut)
+		}
+	}
+}
+
+func TestRunCheck(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir,
+		"clean.json", "{ \"a\": 1 }\n",
+		"dirty.json", `{"a":1,"password":"x"}`,
+	)
+
+	tests := []struct {
+		name string
+		file string
+		code int
+		out  string
+	}{
+		{"unchanged despite formatting", files[0], 0, ""},
+		{"would change", files[1], 1, files[1] + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := readFile(t, tt.file)
+			code, out, errOut := shake(t, "", "exclude", "-check", "-file", tt.file, "$.password")
+			if code != tt.code || out != tt.out {
+				t.Errorf("got exit %d, stdout %q, stderr %q; want exit %d, stdout %q", code, out, errOut, tt.code, tt.out)
+			}
+			if after := readFile(t, tt.file); after != before {
+				t.Errorf("-check modified the file: %q", after)
+			}
+		})
+	}
+
+	t.Run("stdin", func(t *testing.T) {
+		code, out, _ := shake(t, `{"password":"x"}`, "exclude", "-check", "$.password")
+		if code != 1 || out != "<stdin>\n" {
+			t.Errorf("got exit %d, stdout %q", code, out)
+		}
+	})
+}
+
+func TestRunInPlace(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir,
+		"dirty.json", `{"a":1,"password":"x"}`,
+		"clean.json", "{ \"a\": 1 }\n",
+	)
+	if err := os.Chmod(files[0], 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range files {
+		if code, _, errOut := shake(t, "", "exclude", "-i", "-file", f, "$.password"); code != 0 {
+			t.Fatalf("%s: exit %d: %s", f, code, errOut)
+		}
+	}
+
+	if got := readFile(t, files[0]); got != "{\"a\":1}\n" {
+		t.Errorf("dirty.json: got %q", got)
+	}
+	if fi, err := os.Stat(files[0]); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0o600 {
+		t.Errorf("dirty.json: mode %v, want 0600", fi.Mode().Perm())
+	}
+	if got := readFile(t, files[1]); got != "{ \"a\": 1 }\n" {
+		t.Errorf("clean.json should be left untouched, got %q", got)
+	}
+}
+
+func TestRunInPlaceSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := writeFiles(t, dir, "real/a.json", `{"a":1,"password":"x"}`)[0]
+	link := filepath.Join(dir, "link.json")
+	if err := os.Symlink(target, link); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+
+	if code, _, errOut := shake(t, "", "exclude", "-i", "-file", link, "$.password"); code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+
+	if fi, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link.json was replaced by a regular file")
+	}
+	if got := readFile(t, target); got != "{\"a\":1}\n" {
+		t.Errorf("target: got %q", got)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("temporary file left next to the link: %v", entries)
+	}
+}
+
+func TestRunQueryFile(t *testing.T) {
+	dir := t.TempDir()
+	files := writeFiles(t, dir, "deny.txt", "# secrets\n$.password\n\n  $.token  \n")
+
+	code, out, errOut := shake(t, `{"a":1,"b":2,"password":"x","token":"y"}`,
+		"exclude", "-query-file", files[0], "$.b")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if out != "{\"a\":1}\n" {
+		t.Errorf("got %q", out)
+	}
+
+	code, _, errOut = shake(t, `{}`, "-query-file", filepath.Join(dir, "missing.txt"))
+	if code != 1 || !strings.Contains(errOut, "read query file") {
+		t.Errorf("missing query file: got exit %d, stderr %q", code, errOut)
+	}
+}
+
+func TestReadQueryFile(t *testing.T) {
+	files := writeFiles(t, t.TempDir(), "q.txt", "\n# comment\n$.a\r\n\t$.b\n#$.c\n")
+	got, err := readQueryFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"$.a", "$.b"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunSeveralFiles(t *testing.T) {
+	t.Run("next to inputs", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeFiles(t, dir, "a.json", `{"a":1,"t":1}`, "b.json", `{"b":2,"t":2}`)
+		if code, _, errOut := shake(t, "", "exclude", "-file", files[0], "-file", files[1], "$.t"); code != 0 {
+			t.Fatalf("exit %d: %s", code, errOut)
+		}
+		if got := readFile(t, filepath.Join(dir, "a.shaken.json")); got != "{\"a\":1}\n" {
+			t.Errorf("a.shaken.json: got %q", got)
+		}
+		if got := readFile(t, filepath.Join(dir, "b.shaken.json")); got != "{\"b\":2}\n" {
+			t.Errorf("b.shaken.json: got %q", got)
+		}
+	})
+
+	t.Run("output dir", func(t *testing.T) {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		if err := os.Mkdir(out, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		files := writeFiles(t, dir, "a.json", `{"a":1,"t":1}`)
+		if code, _, errOut := shake(t, "", "exclude", "-file", files[0], "-output-dir", out, "$.t"); code != 0 {
+			t.Fatalf("exit %d: %s", code, errOut)
+		}
+		if got := readFile(t, filepath.Join(out, "a.shaken.json")); got != "{\"a\":1}\n" {
+			t.Errorf("got %q", got)
+		}
+	})
+
+	t.Run("colliding outputs", func(t *testing.T) {
+		dir := t.TempDir()
+		out := filepath.Join(dir, "out")
+		files := writeFiles(t, dir, "x/a.json", `{"t":1}`, "y/a.json", `{"t":2}`)
+		code, _, errOut := shake(t, "", "exclude", "-file", files[0], "-file", files[1], "-output-dir", out, "$.t")
+		if code != 1 || !strings.Contains(errOut, "both be written") {
+			t.Errorf("got exit %d, stderr %q", code, errOut)
+		}
+		if _, err := os.Stat(filepath.Join(out, "a.shaken.json")); !os.IsNotExist(err) {
+			t.Errorf("nothing should be written on a collision, stat: %v", err)
+		}
+	})
+
+	t.Run("output overwrites input", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeFiles(t, dir, "a.json", `{"t":1}`, "a.shaken.json", `{"t":2}`)
+		code, _, errOut := shake(t, "", "exclude", "-file", files[0], "-file", files[1], "$.t")
+		if code != 1 || !strings.Contains(errOut, "would overwrite input") {
+			t.Errorf("got exit %d, stderr %q", code, errOut)
+		}
+		if got := readFile(t, files[1]); got != `{"t":2}` {
+			t.Errorf("input was overwritten: %q", got)
+		}
+	})
+
+	t.Run("keep going", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeFiles(t, dir, "bad.json", `{"t":`, "good.json", `{"g":1,"t":1}`)
+		args := []string{"exclude", "-file", files[0], "-file", files[1], "$.t"}
+
+		code, _, errOut := shake(t, "", args...)
+		if code != 1 || !strings.HasPrefix(errOut, files[0]+": ") {
+			t.Errorf("got exit %d, stderr %q", code, errOut)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "good.shaken.json")); !os.IsNotExist(err) {
+			t.Errorf("the run should stop at the first failure, stat: %v", err)
+		}
+
+		code, _, _ = shake(t, "", append([]string{"exclude", "-keep-going"}, args[1:]...)...)
+		if code != 1 {
+			t.Errorf("-keep-going: got exit %d, want 1", code)
+		}
+		if got := readFile(t, filepath.Join(dir, "good.shaken.json")); got != "{\"g\":1}\n" {
+			t.Errorf("-keep-going: got %q", got)
+		}
+	})
+
+	t.Run("check", func(t *testing.T) {
+		dir := t.TempDir()
+		files := writeFiles(t, dir, "a.json", `{"a":1}`, "b.json", `{"t":1}`, "c.json", `{"t":2}`)
+		code, out, errOut := shake(t, "", "exclude", "-check", "-file", files[0], "-file", files[1], "-file", files[2], "$.t")
+		if code != 1 {
+			t.Errorf("exit %d: %s", code, errOut)
+		}
+		if want := files[1] + "\n" + files[2] + "\n"; out != want {
+			t.Errorf("got %q, want %q", out, want)
+		}
+	})
+}
+
+func TestRunFlagConflicts(t *testing.T) {
+	file := writeFiles(t, t.TempDir(), "a.json", `{}`)[0]
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"check with output", []string{"-check", "-file", file, "-output", "out.json", "$.a"}, "-check cannot be combined with -output"},
+		{"output dir without file", []string{"-output-dir", "out", "$.a"}, "-output-dir requires -file"},
+		{"output with several files", []string{"-file", file, "-file", file, "-output", "out.json", "$.a"}, "-output cannot be combined with several -file inputs"},
+		{"output dir with check", []string{"-file", file, "-output-dir", "out", "-check", "$.a"}, "-output-dir cannot be combined with -check or -i"},
+		{"output dir with in place", []string{"-file", file, "-output-dir", "out", "-i", "$.a"}, "-output-dir cannot be combined with -check or -i"},
+		{"in place without file", []string{"-i", "$.a"}, "-i requires -file"},
+		{"in place with output", []string{"-i", "-file", file, "-output", "out.json", "$.a"}, "-i cannot be combined with -output"},
+		{"in place with check", []string{"-i", "-check", "-file", file, "$.a"}, "-i cannot be combined with -check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, out, errOut := shake(t, "", tt.args...)
+			if code != 1 || out != "" || !strings.Contains(errOut, tt.want) {
+				t.Errorf("got exit %d, stdout %q, stderr %q; want exit 1 and %q", code, out, errOut, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := writeFiles(t, dir, "a.json", "old")[0]
+	if err := os.Chmod(path, 0o640); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeFileAtomic(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, path); got != "new" {
+		t.Errorf("got %q", got)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0o640 {
+		t.Errorf("mode %v, want 0640", fi.Mode().Perm())
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("temporary file left behind: %v", entries)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, "missing.json"), []byte("x")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
+
+func TestRunVersion(t *testing.T) {
+	for _, args := range [][]string{{"version"}, {"-version"}} {
+		code, out, _ := shake(t, "", args...)
+		if code != 0 || !strings.HasPrefix(out, "shake ") {
+			t.Errorf("%v: got exit %d, stdout %q", args, code, out)
+		}
+	}
+}
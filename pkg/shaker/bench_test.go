@@ -0,0 +1,132 @@
+package shaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// userDoc builds {"id":1,"user":{...}} where user holds n objects, each
+// with a handful of fields, so the "user" subtree dominates the document.
+func userDoc(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"id":1,"user":{`)
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `"k%d":{"name":"n%d","tags":["a","b"],"secret":%d}`, i, i, i)
+	}
+	b.WriteString(`}}`)
+	return b.Bytes()
+}
+
+func decodeDoc(b *testing.B, input []byte) any {
+	b.Helper()
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		b.Fatal(err)
+	}
+	return tree
+}
+
+// BenchmarkWalkExcludeLargeSubtree walks documents whose excluded subtree
+// grows by two orders of magnitude. Dropping an accepted subtree should not
+// descend into it, so time and allocations should stay flat across sizes.
+func BenchmarkWalkExcludeLargeSubtree(b *testing.B) {
+	queries := []struct {
+		name string
+		q    Query
+	}{
+		{"direct", MustCompile(Exclude("$.user"))},
+		{"descendant", MustCompile(Exclude("$.user", "$..missing"))},
+	}
+
+	for _, tt := range queries {
+		q := tt.q
+		for _, n := range []int{100, 10_000} {
+			b.Run(fmt.Sprintf("%s/n=%d", tt.name, n), func(b *testing.B) {
+				tree := decodeDoc(b, userDoc(n))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for b.Loop() {
+					if _, err := q.Walk(tree); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// flatDoc builds a single object with n scalar members k0…k(n-1).
+func flatDoc(n int) []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i := range n {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `"k%d":%d`, i, i)
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
+
+// BenchmarkShakeExcludeFlatSparse removes two members from a wide, flat
+// object. The result is nearly the whole input, so allocations here are
+// dominated by copying the surviving members; compare against "none",
+// which excludes nothing, to see what the copy costs.
+func BenchmarkShakeExcludeFlatSparse(b *testing.B) {
+	queries := []struct {
+		name string
+		q    Query
+	}{
+		{"two", MustCompile(Exclude("$.k1", "$.k2"))},
+		{"none", MustCompile(Exclude("$.missing"))},
+	}
+
+	for _, tt := range queries {
+		q := tt.q
+		for _, n := range []int{100, 10_000} {
+			b.Run(fmt.Sprintf("%s/n=%d", tt.name, n), func(b *testing.B) {
+				tree := decodeDoc(b, flatDoc(n))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for b.Loop() {
+					if _, err := q.Walk(tree); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkShakeInvalidInput measures the rejection path. Input that cannot
+// start a JSON value fails before a decoder is allocated; input that starts
+// plausibly pays for decoding up to the error.
+func BenchmarkShakeInvalidInput(b *testing.B) {
+	q := MustCompile(Include("$.name"))
+	inputs := []struct {
+		name  string
+		input []byte
+	}{
+		{"not-json", []byte(`<html><body>error</body></html>`)},
+		{"malformed", []byte(`{"name":"a",}`)},
+	}
+
+	for _, tt := range inputs {
+		b.Run(tt.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := Shake(tt.input, q); err == nil {
+					b.Fatal("expected error")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package shaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// FromConfig reads a JSON shake policy and returns it as a compiled [Query].
+//
+// The config is a [ShakeRequest], limits included:
+//
+//	{
+//	    "mode": "exclude",
+//	    "paths": ["$..password", "$..token"],
+//	    "limits": {"maxDepth": 200, "maxPathCount": 50}
+//	}
+//
+// A config file is trusted, so unlike a decoded [ShakeRequest] its limits
+// may loosen the defaults: omitted limits keep their defaults and 0
+// disables a limit. The query is compiled eagerly so that a bad policy
+// fails at load time rather than on the first document, which suits
+// configs embedded with go:embed or mounted from a file.
+func FromConfig(r io.Reader) (Query, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Query{}, fmt.Errorf("shake config: %w", err)
+	}
+
+	// Decode through an alias so that errors carry the config prefix
+	// rather than ShakeRequest.UnmarshalJSON's.
+	type aux ShakeRequest
+	var raw aux
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return Query{}, fmt.Errorf("shake config: %w", err)
+	}
+
+	req := ShakeRequest(raw)
+	if err := req.check("shake config"); err != nil {
+		return Query{}, err
+	}
+	q, err := req.Query(WithLimitCeiling(NoLimits())).Compile()
+	if err != nil {
+		return Query{}, fmt.Errorf("shake config: %w", err)
+	}
+	return q, nil
+}
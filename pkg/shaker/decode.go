@@ -0,0 +1,152 @@
+package shaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// DuplicateKeyError is returned under [WithRejectDuplicateKeys] when an
+// object in the input repeats a member name. Path is the normalized
+// JSONPath of the repeated member, e.g. $['user']['role'].
+type DuplicateKeyError struct {
+	Path string
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("shaker: duplicate object key at %s", e.Path)
+}
+
+// tokenDecoder builds the same map/slice tree as [json.Decoder.Decode] with
+// UseNumber, but walks the input token by token so that per-value concerns
+// (original bytes of scalars, repeated keys) can be handled during decoding
+// instead of in a second pass over the tree.
+type tokenDecoder struct {
+	input []byte
+	dec   *json.Decoder
+	cfg   shakeConfig
+
+	// path holds the member names (string) and indices (int) leading to
+	// the current value. It is only tracked when duplicate keys are
+	// rejected, since it exists to name the offending member.
+	path []any
+}
+
+func decodeTokens(input []byte, cfg shakeConfig) (any, error) {
+	d := &tokenDecoder{
+		input: input,
+		dec:   json.NewDecoder(bytes.NewReader(input)),
+		cfg:   cfg,
+	}
+	d.dec.UseNumber()
+	return d.value()
+}
+
+func (d *tokenDecoder) value() (any, error) {
+	start := d.dec.InputOffset()
+	tok, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		return d.object()
+	case json.Delim('['):
+		return d.array()
+	}
+
+	// null stays a plain nil, as with json.Decoder, so that the walker
+	// treats null members the same whether or not raw scalars are on.
+	if tok != nil && d.cfg.rawScalars {
+		// The span since the previous token may start with the ',' or ':'
+		// separator and whitespace; neither can begin a scalar.
+		raw := bytes.TrimLeft(d.input[start:d.dec.InputOffset()], " \t\r\n,:")
+		return json.RawMessage(raw), nil
+	}
+	return tok, nil
+}
+
+func (d *tokenDecoder) object() (any, error) {
+	obj := make(map[string]any)
+	for d.dec.More() {
+		tok, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+
+		if d.cfg.rejectDuplicateKeys {
+			d.path = append(d.path, key)
+			if _, dup := obj[key]; dup {
+				return nil, &DuplicateKeyError{Path: normalizedPath(d.path)}
+			}
+		}
+
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		obj[key] = v
+
+		if d.cfg.rejectDuplicateKeys {
+			d.path = d.path[:len(d.path)-1]
+		}
+	}
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (d *tokenDecoder) array() (any, error) {
+	arr := make([]any, 0)
+	for d.dec.More() {
+		if d.cfg.rejectDuplicateKeys {
+			d.path = append(d.path, len(arr))
+		}
+
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+
+		if d.cfg.rejectDuplicateKeys {
+			d.path = d.path[:len(d.path)-1]
+		}
+	}
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+// normalizedPath formats path as an RFC 9535 normalized path: every name in
+// single-quoted bracket notation, every index in brackets.
+func normalizedPath(path []any) string {
+	var b strings.Builder
+	b.WriteByte('$')
+	for _, seg := range path {
+		switch seg := seg.(type) {
+		case string:
+			b.WriteString("['")
+			for _, r := range seg {
+				switch {
+				case r == '\'' || r == '\\':
+					b.WriteByte('\\')
+					b.WriteRune(r)
+				case r < 0x20:
+					fmt.Fprintf(&b, `\u%04x`, r)
+				default:
+					b.WriteRune(r)
+				}
+			}
+			b.WriteString("']")
+		case int:
+			fmt.Fprintf(&b, "[%d]", seg)
+		}
+	}
+	return b.String()
+}
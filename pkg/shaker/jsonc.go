@@ -0,0 +1,102 @@
+package shaker
+
+import (
+	"bytes"
+	"errors"
+)
+
+// WithJSONC accepts JSON with comments, as found in hand-written config
+// files: // line comments, /* block */ comments and trailing commas before
+// a closing } or ]. They are removed before decoding; text inside string
+// values, including "//" in URLs, is never touched. The output is plain
+// JSON.
+//
+//	out, err := shaker.Shake(settings, shaker.Exclude("$..token"), shaker.WithJSONC())
+func WithJSONC() ShakeOption {
+	return func(c *shakeConfig) { c.jsonc = true }
+}
+
+var errUnterminatedComment = errors.New("shaker: unterminated block comment")
+
+// stripJSONC returns a copy of input with comments and trailing commas
+// replaced by spaces. Replacing rather than deleting keeps byte offsets,
+// and so decoder error positions, pointing at the original text; newlines
+// inside block comments are kept for the same reason.
+func stripJSONC(input []byte) ([]byte, error) {
+	out := make([]byte, len(input))
+	copy(out, input)
+
+	// First pass: blank out comments, skipping over strings.
+	for i := 0; i < len(out); i++ {
+		switch out[i] {
+		case '"':
+			i = skipString(out, i)
+		case '/':
+			if i+1 >= len(out) {
+				continue
+			}
+			switch out[i+1] {
+			case '/':
+				for ; i < len(out) && out[i] != '\n'; i++ {
+					out[i] = ' '
+				}
+			case '*':
+				n := bytes.Index(out[i+2:], []byte("*/"))
+				if n < 0 {
+					return nil, errUnterminatedComment
+				}
+				end := i + 2 + n + 2
+				for ; i < end; i++ {
+					if out[i] != '\n' {
+						out[i] = ' '
+					}
+				}
+				i--
+			}
+		}
+	}
+
+	// Second pass: blank out a comma that follows a value and whose next
+	// significant byte closes a container. Comments are already whitespace
+	// at this point. A comma after [ { or another comma is left for the
+	// decoder to reject.
+	var prev byte
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case isSpace(c):
+			continue
+		case c == '"':
+			i = skipString(out, i)
+		case c == ',' && prev != ',' && prev != '[' && prev != '{':
+			j := i + 1
+			for j < len(out) && isSpace(out[j]) {
+				j++
+			}
+			if j < len(out) && (out[j] == '}' || out[j] == ']') {
+				out[i] = ' '
+				continue
+			}
+		}
+		prev = c
+	}
+	return out, nil
+}
+
+// skipString returns the index of the quote closing the string that opens
+// at b[i], or len(b)-1 if it is unterminated; the decoder reports that.
+func skipString(b []byte, i int) int {
+	for i++; i < len(b); i++ {
+		switch b[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return len(b) - 1
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
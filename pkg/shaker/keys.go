@@ -0,0 +1,108 @@
+package shaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// MaxDistinctKeys is the default cap on the number of distinct keys
+// [KeySet] collects (10 000).
+const MaxDistinctKeys = 10_000
+
+// KeyLimitError is returned when a document holds more distinct keys than
+// the configured cap.
+type KeyLimitError struct {
+	Limit int
+}
+
+func (e *KeyLimitError) Error() string {
+	return fmt.Sprintf("shaker: document has more than %d distinct keys", e.Limit)
+}
+
+// KeySetOption configures optional behaviour for [KeySet].
+type KeySetOption func(*keySetConfig)
+
+type keySetConfig struct {
+	maxKeys int
+}
+
+// WithMaxKeys caps the number of distinct keys [KeySet] collects before it
+// fails with a [KeyLimitError]. Pass 0 to disable the cap.
+func WithMaxKeys(n int) KeySetOption {
+	return func(c *keySetConfig) { c.maxKeys = n }
+}
+
+// KeySet returns every distinct object key that appears anywhere in the
+// input, sorted. Array indices are not keys and are never reported.
+//
+// It answers "which fields could this payload contain?" — for schema
+// discovery or for drafting an exclude denylist — without a query. The
+// input is scanned as a token stream, so no tree is built.
+//
+// The result set is bounded by [MaxDistinctKeys] so that a hostile payload
+// with millions of unique keys cannot exhaust memory; use [WithMaxKeys] to
+// change the bound.
+func KeySet(input []byte, opts ...KeySetOption) ([]string, error) {
+	cfg := keySetConfig{maxKeys: MaxDistinctKeys}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+
+	// One frame per open container. In an object, expectKey tells whether
+	// the next string token is a member name or a member value.
+	type frame struct {
+		object    bool
+		expectKey bool
+	}
+	var stack []frame
+	seen := make(map[string]struct{})
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if n := len(stack); n > 0 && stack[n-1].object && stack[n-1].expectKey {
+			if tok == json.Delim('}') {
+				stack = stack[:n-1]
+			} else {
+				seen[tok.(string)] = struct{}{}
+				if cfg.maxKeys > 0 && len(seen) > cfg.maxKeys {
+					return nil, &KeyLimitError{Limit: cfg.maxKeys}
+				}
+				stack[n-1].expectKey = false
+			}
+		} else {
+			if n > 0 && stack[n-1].object {
+				// The member value starts here; once it is complete the
+				// object expects another key or its closing brace.
+				stack[n-1].expectKey = true
+			}
+			switch tok {
+			case json.Delim('{'):
+				stack = append(stack, frame{object: true, expectKey: true})
+			case json.Delim('['):
+				stack = append(stack, frame{})
+			case json.Delim(']'):
+				stack = stack[:n-1]
+			}
+		}
+
+		if len(stack) == 0 {
+			break
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for k := range seen {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
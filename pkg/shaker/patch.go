@@ -0,0 +1,262 @@
+package shaker
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MergePatch shakes input and returns an RFC 7386 JSON Merge Patch that
+// turns input into the shaken result.
+//
+// Removed object members appear as null. Merge patch has no way to address
+// individual array elements, so any array whose contents changed is
+// replaced as a whole by its shaken value. An unchanged document yields {}.
+//
+// The patch is derived from the difference between input and result, so it
+// works for include queries as well, though it is most natural for exclude:
+//
+//	patch, err := shaker.MergePatch(doc, shaker.Exclude("$.user.password"))
+//	// {"user":{"password":null}}
+//
+// Options apply as they do to [Shake]: the decoding options to input, and
+// [WithIndent] and [WithRawScalars] to how the patch is written.
+func MergePatch(input []byte, q Query, opts ...ShakeOption) ([]byte, error) {
+	cfg := newShakeConfig(opts)
+
+	tree, result, err := walk(input, q, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, changed := diff(tree, result, true)
+	if !changed {
+		return []byte("{}"), nil
+	}
+	return cfg.marshal(patch)
+}
+
+// ShakeDiff returns the parts of after whose values differ from before:
+// changed members, recursively, plus members that before did not have.
+// Members that after dropped are not reported, since they are not part of
+// after. Numbers are compared as written, so 1.0 and 1 count as different.
+//
+// Arrays are compared index by index; if any element or the length
+// differs, the whole array from after is returned, because the positions
+// of the surviving elements would otherwise be lost. When nothing changed
+// the result is an empty container of after's kind ({} or []), or nil
+// bytes when after is a scalar, since any scalar output, null included,
+// would read as a change to that value.
+//
+// This makes a structural diff a selection source, for change-data-capture
+// payloads that should only carry what changed:
+//
+//	delta, err := shaker.ShakeDiff(previous, current)
+//
+// The decoding options apply to both documents, and [WithIndent] and
+// [WithRawScalars] to how the result is written.
+func ShakeDiff(before, after []byte, opts ...ShakeOption) ([]byte, error) {
+	cfg := newShakeConfig(opts)
+
+	b, err := cfg.decode(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := cfg.decode(after)
+	if err != nil {
+		return nil, err
+	}
+
+	delta, changed := diff(b, a, false)
+	if !changed {
+		switch a.(type) {
+		case map[string]any:
+			return []byte("{}"), nil
+		case []any:
+			return []byte("[]"), nil
+		default:
+			return nil, nil
+		}
+	}
+	return cfg.marshal(delta)
+}
+
+// diff reports whether before and after differ and, if so, returns the
+// parts of after that changed. Objects are compared member by member;
+// every other value, arrays included, is taken wholesale from after. With
+// markRemoved, members missing from after are reported as null, which
+// makes the result an RFC 7386 merge patch.
+func diff(before, after any, markRemoved bool) (any, bool) {
+	b, bok := before.(map[string]any)
+	a, aok := after.(map[string]any)
+	if !bok || !aok {
+		if reflect.DeepEqual(before, after) {
+			return nil, false
+		}
+		return after, true
+	}
+
+	delta := make(map[string]any)
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			delta[k] = av
+			continue
+		}
+		if d, changed := diff(bv, av, markRemoved); changed {
+			delta[k] = d
+		}
+	}
+	if markRemoved {
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				delta[k] = nil
+			}
+		}
+	}
+	return delta, len(delta) > 0
+}
+
+// ShakeWithPatch shakes input and also returns an RFC 6902 JSON Patch that
+// turns input into the result, for audit trails that must record exactly
+// what a shake removed:
+//
+//	out, patch, err := shaker.ShakeWithPatch(doc, shaker.Exclude("$.user.password"))
+//	// patch: [{"op":"remove","path":"/user/password"}]
+//
+// Object members are addressed individually, with "~" and "/" in keys
+// escaped as JSON Pointer requires, and operations are ordered by key.
+// Arrays are compared index by index while their length is unchanged.
+// Dropped elements get one "remove" each, in descending index order so
+// that applying them in sequence keeps the remaining indices valid. Only
+// when an array both lost elements and had others modified does it get a
+// single "replace" of the whole array. An unchanged document yields [].
+//
+// Options apply as they do to [Shake]; [WithIndent] and [WithRawScalars]
+// govern both the result and the patch.
+func ShakeWithPatch(input []byte, q Query, opts ...ShakeOption) (result, patch []byte, err error) {
+	cfg := newShakeConfig(opts)
+
+	tree, shaken, err := walk(input, q, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err = cfg.marshal(shaken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ops := []patchOp{}
+	if err := jsonPatch(&ops, cfg, "", tree, shaken); err != nil {
+		return nil, nil, err
+	}
+	patch, err = cfg.marshal(ops)
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, patch, nil
+}
+
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// jsonPatch appends to ops the operations that turn before into after;
+// pointer is the JSON Pointer of both values, and cfg encodes the values
+// the operations carry.
+func jsonPatch(ops *[]patchOp, cfg shakeConfig, pointer string, before, after any) error {
+	switch b := before.(type) {
+	case map[string]any:
+		if a, ok := after.(map[string]any); ok {
+			keys := make([]string, 0, len(b)+len(a))
+			for k := range b {
+				keys = append(keys, k)
+			}
+			for k := range a {
+				if _, ok := b[k]; !ok {
+					keys = append(keys, k)
+				}
+			}
+			slices.Sort(keys)
+
+			for _, k := range keys {
+				p := pointer + "/" + pointerEscaper.Replace(k)
+				bv, inBefore := b[k]
+				av, inAfter := a[k]
+				switch {
+				case !inAfter:
+					*ops = append(*ops, patchOp{Op: "remove", Path: p})
+				case !inBefore:
+					if err := appendValueOp(ops, cfg, "add", p, av); err != nil {
+						return err
+					}
+				default:
+					if err := jsonPatch(ops, cfg, p, bv, av); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+	case []any:
+		a, ok := after.([]any)
+		if ok && len(a) == len(b) {
+			for i := range b {
+				if err := jsonPatch(ops, cfg, pointer+"/"+strconv.Itoa(i), b[i], a[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if ok && len(a) < len(b) {
+			if dropped, ok := droppedElements(b, a); ok {
+				for _, i := range slices.Backward(dropped) {
+					*ops = append(*ops, patchOp{Op: "remove", Path: pointer + "/" + strconv.Itoa(i)})
+				}
+				return nil
+			}
+		}
+	}
+
+	if reflect.DeepEqual(before, after) {
+		return nil
+	}
+	return appendValueOp(ops, cfg, "replace", pointer, after)
+}
+
+// droppedElements returns, in ascending order, the indices of the elements
+// of before that are missing from after, and reports whether after is
+// exactly before without them. The walker keeps element order, so the
+// survivors are a subsequence of before; matching each one to the first
+// equal element left is enough to find it.
+func droppedElements(before, after []any) ([]int, bool) {
+	var dropped []int
+	j := 0
+	for i, bv := range before {
+		if j < len(after) && reflect.DeepEqual(bv, after[j]) {
+			j++
+			continue
+		}
+		dropped = append(dropped, i)
+	}
+	return dropped, j == len(after)
+}
+
+func appendValueOp(ops *[]patchOp, cfg shakeConfig, op, pointer string, v any) error {
+	raw, err := cfg.marshalCompact(v)
+	if err != nil {
+		return err
+	}
+	*ops = append(*ops, patchOp{Op: op, Path: pointer, Value: raw})
+	return nil
+}
+
+// pointerEscaper escapes a member name for use as a JSON Pointer reference
+// token (RFC 6901). The replacer makes a single pass, so the "~" it writes
+// for "/" is not escaped again.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
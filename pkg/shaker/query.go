@@ -4,6 +4,14 @@ import "github.com/mibar/jsonpath/pkg/jsonpath"
 
 type (
 	// Query describes a set of JSONPath expressions and a mode (include or exclude).
+	//
+	// Expressions may be relative to a prefix set with [Query.WithPrefix]:
+	// relative paths (".name", "[0]") are resolved against it, while
+	// absolute ones ("$.id") are used as written. [IncludeUnder] and
+	// [ExcludeUnder] build such a query in one call:
+	//
+	//	q := shaker.Include(".name", ".email").WithPrefix("$.data.user")
+	//	// same as shaker.Include("$.data.user.name", "$.data.user.email")
 	Query = jsonpath.Query
 	// Mode selects between include and exclude behaviour.
 	Mode = jsonpath.Mode
@@ -59,10 +67,62 @@ func DefaultLimits() Limits { return jsonpath.DefaultLimits() }
 func NoLimits() Limits { return jsonpath.NoLimits() }
 
 // Include returns an include-mode [Query] for the given JSONPath expressions.
-func Include(paths ...string) Query { return jsonpath.Include(paths...) }
+// Repeated expressions are kept once, so they neither add trie nodes nor
+// count twice towards [MaxPathCount].
+func Include(paths ...string) Query { return jsonpath.Include(dedupe(paths)...) }
 
 // Exclude returns an exclude-mode [Query] for the given JSONPath expressions.
-func Exclude(paths ...string) Query { return jsonpath.Exclude(paths...) }
+// Repeated expressions are kept once, as with [Include].
+func Exclude(paths ...string) Query { return jsonpath.Exclude(dedupe(paths)...) }
+
+// IncludeUnder returns an include-mode [Query] whose relative paths are
+// resolved under prefix; see [Query.WithPrefix]. It suits handlers that
+// select fields inside a fixed envelope:
+//
+//	q := shaker.IncludeUnder("$.data", ".id", ".name")
+func IncludeUnder(prefix string, paths ...string) Query {
+	return Include(paths...).WithPrefix(prefix)
+}
+
+// ExcludeUnder returns an exclude-mode [Query] whose relative paths are
+// resolved under prefix, as with [IncludeUnder].
+func ExcludeUnder(prefix string, paths ...string) Query {
+	return Exclude(paths...).WithPrefix(prefix)
+}
+
+// dedupe drops repeated expressions, keeping first-seen order. Only exact
+// duplicates are removed: "$.a" and ".a" differ once a prefix is applied.
+func dedupe(paths []string) []string {
+	if len(paths) < 2 {
+		return paths
+	}
+
+	seen := make(map[string]struct{}, len(paths))
+	out := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		out = append(out, p)
+	}
+	return out
+}
 
 // MustCompile is like [Query.Compile] but panics on error.
 func MustCompile(q Query) Query { return jsonpath.MustCompile(q) }
+
+// Validate reports whether q would compile: every path parses and the
+// query fits its [Limits] ([MaxPathCount], [MaxPathLength]). Parse errors
+// are aggregated as by [Query.Compile]; a valid query yields nil.
+//
+// It needs no document, so handlers can reject a bad query up front:
+//
+//	if err := shaker.Validate(q); err != nil {
+//	    http.Error(w, err.Error(), http.StatusBadRequest)
+//	    return
+//	}
+func Validate(q Query) error {
+	_, err := q.Compile()
+	return err
+}
@@ -50,28 +50,198 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 )
 
+// ShakeOption configures optional behaviour for [Shake].
+type ShakeOption func(*shakeConfig)
+
+type shakeConfig struct {
+	rawScalars          bool
+	rejectDuplicateKeys bool
+	jsonc               bool
+	detectCycles        bool
+	skipEmpty           bool
+
+	indented       bool
+	prefix, indent string
+}
+
+// WithIndent formats the output like [json.MarshalIndent]: each element on
+// a new line beginning with prefix, followed by one copy of indent per
+// nesting level.
+func WithIndent(prefix, indent string) ShakeOption {
+	return func(c *shakeConfig) {
+		c.indented = true
+		c.prefix, c.indent = prefix, indent
+	}
+}
+
+// WithRawScalars copies kept scalar leaves (strings, numbers and booleans)
+// verbatim from the input instead of re-encoding them. null has only one
+// spelling and is handled exactly as without the option, so the option
+// never changes which members appear in the output.
+//
+// Decoding with [json.Decoder.UseNumber] already preserves numeric values;
+// this option also preserves their spelling (1.200, 1E3) and the original
+// escapes inside strings, for consumers that hash or diff the exact bytes.
+// Objects and arrays are still re-encoded, and HTML characters are not
+// escaped since the scalar bytes are emitted as-is.
+func WithRawScalars() ShakeOption {
+	return func(c *shakeConfig) { c.rawScalars = true }
+}
+
+// WithRejectDuplicateKeys fails with a [DuplicateKeyError] when any object
+// in the input repeats a member name, instead of silently keeping the last
+// value as [encoding/json] does.
+//
+// Parsers disagree on which duplicate wins, so a payload such as
+// {"role":"user","role":"admin"} can pass one component's checks and mean
+// something else to the next. Rejecting it closes that gap when shaking is
+// a security filter.
+func WithRejectDuplicateKeys() ShakeOption {
+	return func(c *shakeConfig) { c.rejectDuplicateKeys = true }
+}
+
+// ErrNotJSON is returned when the input cannot start a JSON value: its first
+// non-whitespace byte is none of { [ " - 0-9 t f n. The check runs before
+// any decoding, so malformed requests are rejected cheaply.
+var ErrNotJSON = errors.New("shaker: input is not JSON")
+
+// mayBeJSON reports whether input's first non-whitespace byte can begin a
+// JSON value. Empty input is left to the decoder, which reports EOF.
+func mayBeJSON(input []byte) bool {
+	for _, b := range input {
+		if isSpace(b) {
+			continue
+		}
+		switch b {
+		case '{', '[', '"', '-', 't', 'f', 'n':
+			return true
+		}
+		return '0' <= b && b <= '9'
+	}
+	return true
+}
+
+func (c shakeConfig) decode(input []byte) (any, error) {
+	if c.jsonc {
+		var err error
+		if input, err = stripJSONC(input); err != nil {
+			return nil, err
+		}
+	}
+	if !mayBeJSON(input) {
+		return nil, ErrNotJSON
+	}
+	if c.rawScalars || c.rejectDuplicateKeys {
+		return decodeTokens(input, c)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(input))
+	dec.UseNumber()
+
+	var tree any
+	if err := dec.Decode(&tree); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func (c shakeConfig) marshal(v any) ([]byte, error) {
+	out, err := c.marshalCompact(v)
+	if err != nil || !c.indented {
+		return out, err
+	}
+
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, out, c.prefix, c.indent); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c shakeConfig) marshalCompact(v any) ([]byte, error) {
+	if !c.rawScalars {
+		return json.Marshal(v)
+	}
+
+	// json.Marshal would HTML-escape the contents of each json.RawMessage,
+	// defeating the point of keeping the original bytes.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
 // Shake prunes the input JSON according to the query.
 //
 // In include mode, only matched paths are kept.
 // In exclude mode, matched paths are removed.
 //
+// A document whose root is a scalar has nothing to select below the root:
+// include yields null unless the query includes "$", and exclude returns
+// the scalar unchanged unless the query excludes "$".
+//
 // All path parse errors are aggregated into a single error via [errors.Join].
 // No partial application occurs — if any path is invalid, the entire operation fails.
 //
+// Input that cannot start a JSON value fails fast with [ErrNotJSON];
+// otherwise malformed input returns the decoder's error, such as a
+// [*json.SyntaxError] or [io.ErrUnexpectedEOF].
+//
 // Safety limits ([MaxDepth], [MaxPathLength], [MaxPathCount]) are applied by
 // default. Use [Query.WithLimits] to customise them or [NoLimits] to
 // disable them.
-func Shake(input []byte, q Query) ([]byte, error) {
-	dec := json.NewDecoder(bytes.NewReader(input))
-	dec.UseNumber()
+//
+// The same input bytes and options always give the same output. Object keys
+// are sorted and whitespace is normalized, but numbers are kept as written,
+// so inputs that are equal as values (1.0 and 1) may still differ; options
+// such as [WithIndent] and [WithRawScalars] change the layout and scalars
+// too. Shaking the output again with the same options and a query built
+// from names, wildcards and recursive descent reproduces it byte for byte.
+// Index and slice selectors address positions, which pruning renumbers, so
+// a second pass with such a query may select different elements.
+func Shake(input []byte, q Query, opts ...ShakeOption) ([]byte, error) {
+	cfg := newShakeConfig(opts)
 
-	var tree any
-	if err := dec.Decode(&tree); err != nil {
+	_, result, err := walk(input, q, cfg)
+	if err != nil {
 		return nil, err
 	}
+	return cfg.marshal(result)
+}
+
+func newShakeConfig(opts []ShakeOption) shakeConfig {
+	var cfg shakeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// walk decodes input and applies q, returning both the decoded document and
+// the pruned result. A container root whose contents were all pruned comes
+// back as an empty container of the same kind rather than nil, so callers
+// emit {} or [] instead of null; walkTree does the same for a tree that is
+// already decoded.
+func walk(input []byte, q Query, cfg shakeConfig) (tree, result any, err error) {
+	tree, err = cfg.decode(input)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err = walkTree(tree, q)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree, result, nil
+}
 
+func walkTree(tree any, q Query) (any, error) {
 	result, err := q.Walk(tree)
 	if err != nil {
 		return nil, err
@@ -80,18 +250,193 @@ func Shake(input []byte, q Query) ([]byte, error) {
 	if result == nil {
 		switch tree.(type) {
 		case map[string]any:
-			return []byte("{}"), nil
+			result = map[string]any{}
 		case []any:
-			return []byte("[]"), nil
+			result = []any{}
+		}
+	}
+	return result, nil
+}
+
+// ShakeValue is [Shake] for a document that is already decoded: it prunes
+// tree directly and returns the pruned value, with no JSON encoding or
+// decoding on either side. tree is not modified. Of the options, only
+// [WithCycleDetection] applies.
+//
+// tree should use the shapes [encoding/json] produces (map[string]any,
+// []any, string, bool, nil and numbers). Decode it with
+// [json.Decoder.UseNumber] so that numbers stay [json.Number] and keep
+// their exact value; float64 is accepted but loses precision beyond 2^53.
+//
+// For many documents with one query, [Walker.Tree] avoids recompiling.
+func ShakeValue(tree any, q Query, opts ...ShakeOption) (any, error) {
+	return walkValue(tree, q, newShakeConfig(opts))
+}
+
+// WithCycleDetection makes [ShakeValue] and [Walker.Tree] reject a
+// caller-built tree that contains one of its own maps or slices with
+// [ErrCycle], rather than walk it forever. A decoder never produces such a
+// tree, so the other entry points ignore the option.
+//
+// The check is a separate pass over the tree, so it is off by default. It
+// descends at most [MaxDepth] levels: deeper nesting is left to the walker,
+// which rejects it under the query's own depth limit. A compiled Query does
+// not expose that limit, so a query with MaxDepth disabled is only
+// protected against cycles that close within MaxDepth levels.
+func WithCycleDetection() ShakeOption {
+	return func(c *shakeConfig) { c.detectCycles = true }
+}
+
+// ErrCycle is returned under [WithCycleDetection] when a caller-built tree
+// contains a map or slice inside itself.
+var ErrCycle = errors.New("shaker: tree contains a cycle")
+
+// walkValue is walkTree for trees built by the caller rather than by the
+// decoder, which may be cyclic.
+func walkValue(tree any, q Query, cfg shakeConfig) (any, error) {
+	if cfg.detectCycles && hasCycle(tree, make(map[container]struct{}), 0) {
+		return nil, ErrCycle
+	}
+	return walkTree(tree, q)
+}
+
+// container identifies a map or slice by its backing storage; a slice also
+// by its length, since sub-slices share a pointer.
+type container struct {
+	ptr uintptr
+	len int
+}
+
+// hasCycle reports whether v, found depth levels below the root, contains
+// one of its own ancestors. open holds the containers on the current path
+// only, so a subtree shared by two siblings is not mistaken for a cycle.
+// It stops looking below MaxDepth.
+func hasCycle(v any, open map[container]struct{}, depth int) bool {
+	if depth > MaxDepth {
+		return false
+	}
+
+	var id container
+	switch v := v.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			return false
+		}
+		id = container{ptr: reflect.ValueOf(v).Pointer()}
+	case []any:
+		if len(v) == 0 {
+			return false
 		}
+		id = container{ptr: reflect.ValueOf(v).Pointer(), len: len(v)}
+	default:
+		return false
+	}
+
+	if _, ok := open[id]; ok {
+		return true
 	}
+	open[id] = struct{}{}
+	defer delete(open, id)
 
-	return json.Marshal(result)
+	switch v := v.(type) {
+	case map[string]any:
+		for _, c := range v {
+			if hasCycle(c, open, depth+1) {
+				return true
+			}
+		}
+	case []any:
+		for _, c := range v {
+			if hasCycle(c, open, depth+1) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ShakeChanged is like [Shake] but also reports whether the query changed
+// the document's content. Formatting is ignored: a document that merely
+// gets compacted or has its keys reordered is unchanged.
+//
+// This is the building block for "would this file change?" checks, such as
+// a CI gate that fails while committed JSON still contains secrets.
+func ShakeChanged(input []byte, q Query, opts ...ShakeOption) (out []byte, changed bool, err error) {
+	cfg := newShakeConfig(opts)
+
+	tree, result, err := walk(input, q, cfg)
+	if err != nil {
+		return nil, false, err
+	}
+
+	out, err = cfg.marshal(result)
+	if err != nil {
+		return nil, false, err
+	}
+	return out, !reflect.DeepEqual(tree, result), nil
+}
+
+// ShakeMerge shakes each input with q and returns the results as one JSON
+// array, in input order. The query is compiled once and reused for every
+// input. An input whose contents were all pruned still contributes its
+// empty container ({} or []), so result positions always match inputs,
+// unless [WithSkipEmpty] is given.
+//
+// It produces a single valid document where newline-delimited output would
+// not fit, such as a batch API response:
+//
+//	out, err := shaker.ShakeMerge([][]byte{a, b, c}, shaker.Include("$.id"))
+//	// [{"id":1},{"id":2},{"id":3}]
+//
+// Options apply at both stages. Decoding options ([WithJSONC],
+// [WithRawScalars], [WithRejectDuplicateKeys]) govern how each input is
+// read. [WithIndent] formats the merged array. An error names the failing
+// input by its index.
+func ShakeMerge(inputs [][]byte, q Query, opts ...ShakeOption) ([]byte, error) {
+	cfg := newShakeConfig(opts)
+
+	q, err := q.Compile()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]any, 0, len(inputs))
+	for i, input := range inputs {
+		_, result, err := walk(input, q, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("shaker: input %d: %w", i, err)
+		}
+		if cfg.skipEmpty && isEmpty(result) {
+			continue
+		}
+		results = append(results, result)
+	}
+	return cfg.marshal(results)
+}
+
+// WithSkipEmpty makes [ShakeMerge] leave out results that are null, {} or
+// [], such as inputs that matched nothing under an include query. The
+// positions in the merged array then no longer match the inputs. Other
+// entry points ignore the option.
+func WithSkipEmpty() ShakeOption {
+	return func(c *shakeConfig) { c.skipEmpty = true }
+}
+
+func isEmpty(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case map[string]any:
+		return len(v) == 0
+	case []any:
+		return len(v) == 0
+	}
+	return false
 }
 
 // MustShake is like [Shake] but panics on error.
-func MustShake(input []byte, q Query) []byte {
-	out, err := Shake(input, q)
+func MustShake(input []byte, q Query, opts ...ShakeOption) []byte {
+	out, err := Shake(input, q, opts...)
 	if err != nil {
 		panic(err)
 	}
@@ -107,31 +452,127 @@ func MustShake(input []byte, q Query) []byte {
 //	    Payload map[string]any      `json:"payload"`
 //	    Shake   *shaker.ShakeRequest `json:"shake,omitempty"`
 //	}
+//
+// An optional "limits" object lets the client tighten the safety limits for
+// its own request:
+//
+//	{"mode": "include", "paths": ["$.name"], "limits": {"maxDepth": 200}}
+//
+// Requests come from untrusted clients, so [ShakeRequest.Query] never lets
+// them loosen the defaults; a server that wants to allow that sets its own
+// ceiling with [WithLimitCeiling].
 type ShakeRequest struct {
-	Mode  string   `json:"mode"`  // "include" or "exclude"
-	Paths []string `json:"paths"` // JSONPath expressions
+	Mode   string         `json:"mode"`             // "include" or "exclude"
+	Paths  []string       `json:"paths"`            // JSONPath expressions
+	Limits *RequestLimits `json:"limits,omitempty"` // nil keeps the defaults
+}
+
+// RequestLimits is the JSON form of [Limits] carried by a [ShakeRequest].
+// An absent field keeps the default, and 0 asks for no limit, which is
+// only granted when the server's ceiling is itself unlimited.
+type RequestLimits struct {
+	MaxDepth      *int `json:"maxDepth,omitempty"`
+	MaxPathLength *int `json:"maxPathLength,omitempty"`
+	MaxPathCount  *int `json:"maxPathCount,omitempty"`
 }
 
-// Query returns a [Query] derived from Mode and Paths.
+func (l RequestLimits) validate() error {
+	for _, f := range []struct {
+		name string
+		v    *int
+	}{
+		{"maxDepth", l.MaxDepth},
+		{"maxPathLength", l.MaxPathLength},
+		{"maxPathCount", l.MaxPathCount},
+	} {
+		if f.v != nil && *f.v < 0 {
+			return fmt.Errorf("limits: %s must not be negative, got %d", f.name, *f.v)
+		}
+	}
+	return nil
+}
+
+// RequestOption configures how [ShakeRequest.Query] derives its [Query].
+type RequestOption func(*requestConfig)
+
+type requestConfig struct {
+	ceiling Limits
+}
+
+// WithLimitCeiling caps the requested limits at max instead of at the
+// package defaults, so a server can opt in to letting clients loosen them:
+//
+//	q := req.Query(shaker.WithLimitCeiling(shaker.Limits{MaxDepth: shaker.Ptr(5000)}))
+//
+// A nil field of max means the default and 0 means no ceiling. A request
+// may disable a limit (0) only where max has no ceiling.
+func WithLimitCeiling(max Limits) RequestOption {
+	return func(c *requestConfig) { c.ceiling = max }
+}
+
+// Query returns a [Query] derived from Mode, Paths and Limits.
 //
 // If Mode is "include", it returns [Include](Paths...).
 // If Mode is "exclude", it returns [Exclude](Paths...).
 // For any other Mode, it returns an empty include query.
-func (r ShakeRequest) Query() Query {
+//
+// Requested limits can only tighten the ceiling, which is [DefaultLimits]
+// unless [WithLimitCeiling] sets another; a larger value, or 0, is capped
+// at it. Absent requested limits keep the default, capped at the ceiling.
+// The paths are parsed when the query is compiled, under these limits.
+func (r ShakeRequest) Query(opts ...RequestOption) Query {
+	cfg := requestConfig{ceiling: DefaultLimits()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var q Query
 	switch r.Mode {
 	case "include":
-		return Include(r.Paths...)
+		q = Include(r.Paths...)
 	case "exclude":
-		return Exclude(r.Paths...)
+		q = Exclude(r.Paths...)
 	default:
-		return Include()
+		q = Include()
+	}
+
+	var req RequestLimits
+	if r.Limits != nil {
+		req = *r.Limits
+	}
+	max := cfg.ceiling
+	return q.WithLimits(Limits{
+		MaxDepth:      capLimit(req.MaxDepth, max.MaxDepth, MaxDepth),
+		MaxPathLength: capLimit(req.MaxPathLength, max.MaxPathLength, MaxPathLength),
+		MaxPathCount:  capLimit(req.MaxPathCount, max.MaxPathCount, MaxPathCount),
+	})
+}
+
+// capLimit resolves a requested limit against a ceiling. A nil value falls
+// back to def, and 0 means no limit for both.
+func capLimit(requested, ceiling *int, def int) *int {
+	c := def
+	if ceiling != nil {
+		c = *ceiling
+	}
+	v := def
+	if requested != nil {
+		v = *requested
 	}
+	if c > 0 && (v == 0 || v > c) {
+		v = c
+	}
+	return &v
 }
 
 // UnmarshalJSON implements [json.Unmarshaler].
 //
-// It decodes Mode and Paths from the JSON payload and validates them.
-// Returns an error if mode is invalid or paths is empty.
+// It decodes Mode, Paths and Limits from the JSON payload and checks them:
+// it returns an error if mode is invalid, paths is empty or a limit is
+// negative. Paths are not parsed here, because how much parsing a request
+// may cost depends on the ceiling the server passes to
+// [ShakeRequest.Query]; path errors surface when that query is compiled,
+// by [Validate], [Query.Compile] or [Shake].
 func (r *ShakeRequest) UnmarshalJSON(data []byte) error {
 	// Alias avoids infinite recursion on UnmarshalJSON.
 	type aux ShakeRequest
@@ -140,23 +581,36 @@ func (r *ShakeRequest) UnmarshalJSON(data []byte) error {
 		return err
 	}
 
+	req := ShakeRequest(raw)
+	if err := req.check("shake request"); err != nil {
+		return err
+	}
+
+	*r = req
+	return nil
+}
+
+// check validates Mode, Paths and Limits without parsing the paths. Each
+// error is prefixed with source, which names where the request came from.
+func (r ShakeRequest) check(source string) error {
 	var errs []error
 
-	if len(raw.Paths) == 0 {
-		errs = append(errs, fmt.Errorf("shake request: paths must not be empty"))
+	if len(r.Paths) == 0 {
+		errs = append(errs, fmt.Errorf("%s: paths must not be empty", source))
 	}
 
-	switch raw.Mode {
+	switch r.Mode {
 	case "include", "exclude":
 		// valid
 	default:
-		errs = append(errs, fmt.Errorf("shake request: invalid mode %q (expected \"include\" or \"exclude\")", raw.Mode))
+		errs = append(errs, fmt.Errorf("%s: invalid mode %q (expected \"include\" or \"exclude\")", source, r.Mode))
 	}
 
-	if err := errors.Join(errs...); err != nil {
-		return err
+	if r.Limits != nil {
+		if err := r.Limits.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
 	}
 
-	*r = ShakeRequest(raw)
-	return nil
+	return errors.Join(errs...)
 }
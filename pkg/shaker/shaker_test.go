@@ -1,8 +1,14 @@
 package shaker
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -134,6 +140,23 @@ func TestShakeInvalidJSON(t *testing.T) {
 	}
 }
 
+func TestShakeNotJSON(t *testing.T) {
+	for _, in := range []string{`<html>`, `  hello`, "\n'single'", `invalid`, `+1`, `.5`} {
+		for _, opts := range [][]ShakeOption{nil, {WithRawScalars()}} {
+			if _, err := Shake([]byte(in), Include("$.name"), opts...); !errors.Is(err, ErrNotJSON) {
+				t.Errorf("%q: expected ErrNotJSON, got %v", in, err)
+			}
+		}
+	}
+
+	// Anything that may start a value goes on to the decoder.
+	for _, in := range []string{` {"name":1}`, `[1]`, `"s"`, `-1`, `0`, `true`, `false`, `null`, `{invalid`, `nope`, ``} {
+		if _, err := Shake([]byte(in), Include("$.name")); errors.Is(err, ErrNotJSON) {
+			t.Errorf("%q: rejected before decoding", in)
+		}
+	}
+}
+
 func TestShakeIncludeNoMatchReturnsEmpty(t *testing.T) {
 	input := []byte(`{"name":"John"}`)
 	out, err := Shake(input, Include("$.nonexistent"))
@@ -297,6 +320,282 @@ func TestShakeRequestUnmarshalEmptyMode(t *testing.T) {
 	}
 }
 
+func TestShakeRequestUnmarshalInvalidPath(t *testing.T) {
+	data := []byte(`{"mode":"include","paths":[".name","$[bad"]}`)
+	var r ShakeRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("paths are parsed at compile time, got: %v", err)
+	}
+
+	var pe *ParseError
+	if err := Validate(r.Query()); !errors.As(err, &pe) {
+		t.Errorf("expected ParseError in chain, got: %v", err)
+	}
+}
+
+// nestedArrays returns n nested arrays, [[[…]]], for depth-limit tests.
+func nestedArrays(n int) []byte {
+	return []byte(strings.Repeat("[", n) + strings.Repeat("]", n))
+}
+
+// manyPaths returns n distinct JSONPath expressions.
+func manyPaths(n int) []string {
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("$.k%d", i)
+	}
+	return paths
+}
+
+func TestShakeRequestLimits(t *testing.T) {
+	decode := func(t *testing.T, limits string) ShakeRequest {
+		t.Helper()
+		data := fmt.Sprintf(`{"mode":"exclude","paths":["$..x"],"limits":%s}`, limits)
+		var r ShakeRequest
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	withPaths := func(r ShakeRequest, paths ...string) ShakeRequest {
+		r.Paths = paths
+		return r
+	}
+	var de *DepthError
+
+	tests := []struct {
+		name   string
+		limits string
+		check  func(t *testing.T, r ShakeRequest)
+	}{
+		{
+			name:   "maxDepth tightens",
+			limits: `{"maxDepth":3}`,
+			check: func(t *testing.T, r ShakeRequest) {
+				if _, err := Shake([]byte(`{"a":{"b":1}}`), r.Query()); err != nil {
+					t.Errorf("within limit: %v", err)
+				}
+				if _, err := Shake(nestedArrays(10), r.Query()); !errors.As(err, &de) {
+					t.Errorf("expected DepthError, got %v", err)
+				}
+			},
+		},
+		{
+			name:   "maxPathLength tightens",
+			limits: `{"maxPathLength":8}`,
+			check: func(t *testing.T, r ShakeRequest) {
+				if err := Validate(withPaths(r, "$.abcdef").Query()); err != nil {
+					t.Errorf("within limit: %v", err)
+				}
+				if err := Validate(withPaths(r, "$.abcdefg").Query()); err == nil {
+					t.Error("expected error over the limit")
+				}
+			},
+		},
+		{
+			name:   "maxPathCount tightens",
+			limits: `{"maxPathCount":2}`,
+			check: func(t *testing.T, r ShakeRequest) {
+				if err := Validate(withPaths(r, manyPaths(2)...).Query()); err != nil {
+					t.Errorf("within limit: %v", err)
+				}
+				if err := Validate(withPaths(r, manyPaths(3)...).Query()); err == nil {
+					t.Error("expected error over the limit")
+				}
+			},
+		},
+		{
+			name:   "zero cannot disable",
+			limits: `{"maxDepth":0,"maxPathLength":0,"maxPathCount":0}`,
+			check: func(t *testing.T, r ShakeRequest) {
+				if _, err := Shake(nestedArrays(MaxDepth+10), r.Query()); !errors.As(err, &de) {
+					t.Errorf("expected default MaxDepth to hold, got %v", err)
+				}
+				if err := Validate(withPaths(r, manyPaths(MaxPathCount+1)...).Query()); err == nil {
+					t.Error("expected default MaxPathCount to hold")
+				}
+				if err := Validate(withPaths(r, "$."+strings.Repeat("a", MaxPathLength)).Query()); err == nil {
+					t.Error("expected default MaxPathLength to hold")
+				}
+			},
+		},
+		{
+			name:   "larger value cannot loosen",
+			limits: `{"maxDepth":5000,"maxPathCount":5000}`,
+			check: func(t *testing.T, r ShakeRequest) {
+				if _, err := Shake(nestedArrays(MaxDepth+10), r.Query()); !errors.As(err, &de) {
+					t.Errorf("expected default MaxDepth to hold, got %v", err)
+				}
+				if err := Validate(withPaths(r, manyPaths(MaxPathCount+1)...).Query()); err == nil {
+					t.Error("expected default MaxPathCount to hold")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := decode(t, tt.limits)
+
+			// Round-trip through the wire format.
+			b, err := json.Marshal(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), `"limits":`+tt.limits) {
+				t.Errorf("marshalled %s, want limits %s", b, tt.limits)
+			}
+
+			tt.check(t, r)
+		})
+	}
+}
+
+func TestShakeRequestLimitCeiling(t *testing.T) {
+	request := func(limits *RequestLimits) ShakeRequest {
+		return ShakeRequest{Mode: "exclude", Paths: []string{"$..x"}, Limits: limits}
+	}
+	var de *DepthError
+
+	tests := []struct {
+		name    string
+		req     ShakeRequest
+		max     Limits
+		allowed int // nesting depth that must pass
+		denied  int // nesting depth that must fail; 0 if none
+	}{
+		{
+			name:    "loosened within ceiling",
+			req:     request(&RequestLimits{MaxDepth: Ptr(3000)}),
+			max:     Limits{MaxDepth: Ptr(5000)},
+			allowed: 2000,
+			denied:  3100,
+		},
+		{
+			name:    "capped at ceiling",
+			req:     request(&RequestLimits{MaxDepth: Ptr(9000)}),
+			max:     Limits{MaxDepth: Ptr(2000)},
+			allowed: 1500,
+			denied:  2100,
+		},
+		{
+			name:    "zero capped at ceiling",
+			req:     request(&RequestLimits{MaxDepth: Ptr(0)}),
+			max:     Limits{MaxDepth: Ptr(2000)},
+			allowed: 1500,
+			denied:  2100,
+		},
+		{
+			name:    "zero with unlimited ceiling",
+			req:     request(&RequestLimits{MaxDepth: Ptr(0)}),
+			max:     NoLimits(),
+			allowed: MaxDepth + 10,
+		},
+		{
+			name:    "absent keeps default",
+			req:     request(nil),
+			max:     NoLimits(),
+			allowed: 10,
+			denied:  MaxDepth + 10,
+		},
+		{
+			name:    "absent capped at tighter ceiling",
+			req:     request(nil),
+			max:     Limits{MaxDepth: Ptr(5)},
+			allowed: 3,
+			denied:  10,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.req.Query(WithLimitCeiling(tt.max))
+			if _, err := Shake(nestedArrays(tt.allowed), q); err != nil {
+				t.Errorf("depth %d: %v", tt.allowed, err)
+			}
+			if tt.denied > 0 {
+				if _, err := Shake(nestedArrays(tt.denied), q); !errors.As(err, &de) {
+					t.Errorf("depth %d: expected DepthError, got %v", tt.denied, err)
+				}
+			}
+		})
+	}
+}
+
+func TestShakeRequestLimitsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"negative", `{"mode":"include","paths":["$.a"],"limits":{"maxDepth":-1}}`},
+		{"wrong type", `{"mode":"include","paths":["$.a"],"limits":{"maxPathCount":"many"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r ShakeRequest
+			if err := json.Unmarshal([]byte(tt.data), &r); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestShakeRequestLoosenedOverJSON(t *testing.T) {
+	paths := append(manyPaths(MaxPathCount+1), "$."+strings.Repeat("a", MaxPathLength))
+	body, err := json.Marshal(map[string]any{
+		"mode":   "include",
+		"paths":  paths,
+		"limits": map[string]int{"maxPathCount": 5000, "maxPathLength": 20000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r ShakeRequest
+	if err := json.Unmarshal(body, &r); err != nil {
+		t.Fatalf("a request above the defaults should decode: %v", err)
+	}
+	if err := Validate(r.Query()); err == nil {
+		t.Error("expected the default ceiling to reject the request")
+	}
+	ceiling := WithLimitCeiling(Limits{MaxPathCount: Ptr(10000), MaxPathLength: Ptr(50000)})
+	if err := Validate(r.Query(ceiling)); err != nil {
+		t.Errorf("expected the server's ceiling to admit the request: %v", err)
+	}
+}
+
+func TestShakeRequestNoLimits(t *testing.T) {
+	var r ShakeRequest
+	if err := json.Unmarshal([]byte(`{"mode":"include","paths":["$.a"]}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Limits != nil {
+		t.Errorf("Limits = %+v, want nil", r.Limits)
+	}
+	b, _ := json.Marshal(r)
+	if strings.Contains(string(b), "limits") {
+		t.Errorf("marshalled %s, want no limits member", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(Include("$.name", "$..id", "$.items[0:2]")); err != nil {
+		t.Errorf("valid query: %v", err)
+	}
+
+	err := Validate(Exclude("$.invalid[", "$[bad"))
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Errorf("expected ParseError in chain, got: %v", err)
+	}
+
+	tooMany := Include("$.a", "$.b").WithLimits(Limits{MaxPathCount: Ptr(1)})
+	if err := Validate(tooMany); err == nil {
+		t.Error("expected error for exceeding MaxPathCount")
+	}
+}
+
 func TestShakePreservesLargeNumbers(t *testing.T) {
 	// 9007199254740993 is 2^53 + 1, beyond float64 exact precision.
 	// json.Number (via dec.UseNumber) preserves the string representation.
@@ -322,3 +621,1588 @@ func TestShakePreservesLargeNumbers(t *testing.T) {
 		}
 	})
 }
+
+func TestShakeRawScalars(t *testing.T) {
+	input := []byte(`{"price":1.200,"qty":1E3,"ratio":0.10000000000000000555,"name":"café <b>","tags":["a\/b"],"extra":true}`)
+
+	t.Run("include", func(t *testing.T) {
+		out, err := Shake(input, Include("$.price", "$.qty", "$.ratio", "$.name", "$.tags"), WithRawScalars())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"name":"café <b>","price":1.200,"qty":1E3,"ratio":0.10000000000000000555,"tags":["a\/b"]}`
+		if string(out) != want {
+			t.Errorf("got  %s\nwant %s", out, want)
+		}
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		out, err := Shake(input, Exclude("$.name", "$.tags", "$.extra"), WithRawScalars())
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"price":1.200,"qty":1E3,"ratio":0.10000000000000000555}`
+		if string(out) != want {
+			t.Errorf("got  %s\nwant %s", out, want)
+		}
+	})
+
+	t.Run("default re-encodes strings", func(t *testing.T) {
+		out, err := Shake(input, Include("$.name", "$.tags"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != `{"name":"café \u003cb\u003e","tags":["a/b"]}` {
+			t.Errorf("got %s", out)
+		}
+	})
+}
+
+func TestShakeRawScalarsNull(t *testing.T) {
+	inputs := []string{`{"x":null}`, `{"a":{"x":null,"y":1},"l":[null,1],"x":null}`, `null`}
+	queries := []Query{
+		Include("$.x"), Exclude("$.x"), Exclude("$.y"), Include("$..x"),
+		Include("$.l[*]"), Exclude("$.a.y"), Include("$"),
+	}
+
+	for _, in := range inputs {
+		for _, q := range queries {
+			want, err := Shake([]byte(in), q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Shake([]byte(in), q, WithRawScalars())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(want) {
+				t.Errorf("%s with %v: raw %s, default %s", in, q, got, want)
+			}
+		}
+	}
+}
+
+func TestShakeRawScalarsInvalidJSON(t *testing.T) {
+	for _, in := range []string{`{"a":1,}`, `[1,2`, `{"a" 1}`, ``} {
+		if _, err := Shake([]byte(in), Include("$.a"), WithRawScalars()); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestShakeJSONC(t *testing.T) {
+	input := []byte(`// service config
+{
+	"name": "api", // trailing comment
+	/* block
+	   comment */
+	"url": "https://example.com//path", "note": "a /* not */ comment",
+	"quote": "say \"//hi\"",
+	"token": "x",
+	"hosts": [
+		"a",
+		"b", // last
+	],
+	"empty": [ /* nothing */ ],
+	"nested": {"k": 1,},
+}
+`)
+
+	out, err := Shake(input, Exclude("$.token"), WithJSONC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"empty":[],"hosts":["a","b"],"name":"api","nested":{"k":1},"note":"a /* not */ comment","quote":"say \"//hi\"","url":"https://example.com//path"}`
+	if string(out) != want {
+		t.Errorf("got  %s\nwant %s", out, want)
+	}
+
+	t.Run("raw scalars", func(t *testing.T) {
+		out, err := Shake([]byte(`{"a": 1.50, /* c */ "b": 2, // c
+		}`), Include("$.a", "$.b"), WithJSONC(), WithRawScalars())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != `{"a":1.50,"b":2}` {
+			t.Errorf("got %s", out)
+		}
+	})
+
+	t.Run("input not modified", func(t *testing.T) {
+		in := []byte(`{"a":1,}`)
+		if _, err := Shake(in, Include("$.a"), WithJSONC()); err != nil {
+			t.Fatal(err)
+		}
+		if string(in) != `{"a":1,}` {
+			t.Errorf("input changed to %s", in)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, in := range []string{`{"a":1 /* open`, `{"a":1,,}`, `[,]`, `{"a":1}`[:5]} {
+			if _, err := Shake([]byte(in), Include("$.a"), WithJSONC()); err == nil {
+				t.Errorf("%q: expected error", in)
+			}
+		}
+	})
+
+	t.Run("off by default", func(t *testing.T) {
+		if _, err := Shake([]byte(`{"a":1,}`), Include("$.a")); err == nil {
+			t.Error("expected trailing comma to be rejected without WithJSONC")
+		}
+	})
+}
+
+func TestShakeRejectDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		path  string
+	}{
+		{"root", `{"role":"user","role":"admin"}`, `$['role']`},
+		{"nested", `{"user":{"name":"a","role":"user","role":"admin"}}`, `$['user']['role']`},
+		{"in array", `{"items":[{"id":1},{"id":2,"id":3}]}`, `$['items'][1]['id']`},
+		{"quoted key", `{"it's":1,"it's":2}`, `$['it\'s']`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without the option the last value silently wins.
+			if _, err := Shake([]byte(tt.input), Exclude("$.missing")); err != nil {
+				t.Fatalf("default decoding: %v", err)
+			}
+
+			_, err := Shake([]byte(tt.input), Exclude("$.missing"), WithRejectDuplicateKeys())
+			var de *DuplicateKeyError
+			if !errors.As(err, &de) {
+				t.Fatalf("expected DuplicateKeyError, got %v", err)
+			}
+			if de.Path != tt.path {
+				t.Errorf("Path = %s, want %s", de.Path, tt.path)
+			}
+		})
+	}
+
+	t.Run("same key in sibling objects", func(t *testing.T) {
+		input := []byte(`{"a":{"id":1},"b":{"id":2},"list":[{"id":3},{"id":4}]}`)
+		out, err := Shake(input, Include("$..id"), WithRejectDuplicateKeys())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"a":{"id":1},"b":{"id":2},"list":[{"id":3},{"id":4}]}`; string(out) != want {
+			t.Errorf("got %s, want %s", out, want)
+		}
+	})
+}
+
+func TestShakeNumberFidelity(t *testing.T) {
+	// Values that float64 cannot represent exactly (or at all) must pass
+	// through untouched: json.Number keeps the literal, never a float.
+	tests := []struct {
+		name string
+		num  string
+	}{
+		{"overflowing exponent", "1e400"},
+		{"negative overflowing exponent", "-1e400"},
+		{"underflowing exponent", "1e-400"},
+		{"negative zero", "-0"},
+		{"negative zero float", "-0.0"},
+		{"high precision decimal", "3.141592653589793238462643383279"},
+		{"huge integer", "123456789012345678901234567890"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := []byte(`{"n":` + tt.num + `,"other":1}`)
+			want := `{"n":` + tt.num + `}`
+
+			out, err := Shake(input, Include("$.n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != want {
+				t.Errorf("include: got %s, want %s", out, want)
+			}
+
+			out, err = Shake(input, Exclude("$.other"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != want {
+				t.Errorf("exclude: got %s, want %s", out, want)
+			}
+		})
+	}
+}
+
+func TestShakeIdempotent(t *testing.T) {
+	input := []byte(`{"b":{"secret":"x","n":1.50},"a":[{"id":9007199254740993,"secret":"y"},{"id":2}],"c":"<tag>"}`)
+	queries := []Query{
+		Include("$.a[*].id", "$.c"),
+		Include("$..secret"),
+		Exclude("$..secret"),
+		Exclude("$.b"),
+	}
+
+	for _, q := range queries {
+		once := MustShake(input, q)
+		twice := MustShake(once, q)
+		if string(once) != string(twice) {
+			t.Errorf("not a fixpoint:\nonce  %s\ntwice %s", once, twice)
+		}
+	}
+}
+
+func FuzzShakeIdempotent(f *testing.F) {
+	f.Add([]byte(`{"name":"John","secret":"x","tags":["a","b"]}`))
+	f.Add([]byte(`{"a":{"secret":{"secret":1}},"b":[{"secret":2,"name":-0.0}]}`))
+	f.Add([]byte(`[{"name":1e400},{"x":null},true,"s"]`))
+	f.Add([]byte(`{"name":"caf\u00e9 \u003c/script\u003e","n":1.200}`))
+
+	queries := []Query{
+		MustCompile(Include("$.name", "$..name")),
+		MustCompile(Include("$.*.secret")),
+		MustCompile(Exclude("$..secret")),
+		MustCompile(Exclude("$.tags", "$.*.x")),
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, q := range queries {
+			for _, opts := range [][]ShakeOption{nil, {WithRawScalars()}} {
+				once, err := Shake(input, q, opts...)
+				if err != nil {
+					return
+				}
+				twice, err := Shake(once, q, opts...)
+				if err != nil {
+					t.Fatalf("re-shaking %s: %v", once, err)
+				}
+				if string(once) != string(twice) {
+					t.Fatalf("not a fixpoint for %q:\nonce  %s\ntwice %s", input, once, twice)
+				}
+			}
+		}
+	})
+}
+
+func TestFromConfig(t *testing.T) {
+	cfg := `{"mode":"exclude","paths":["$..password","$.internal"],"limits":{"maxDepth":3}}`
+	q, err := FromConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.IsInclude() {
+		t.Error("expected exclude mode")
+	}
+
+	out, err := Shake([]byte(`{"user":{"name":"a","password":"x"},"internal":1}`), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"user":{"name":"a"}}` {
+		t.Errorf("got %s", out)
+	}
+
+	var de *DepthError
+	if _, err := Shake([]byte(`{"a":{"b":{"c":{"d":{"e":1}}}}}`), q); !errors.As(err, &de) {
+		t.Errorf("expected DepthError from configured limit, got %v", err)
+	}
+}
+
+func TestFromConfigMayLoosenLimits(t *testing.T) {
+	cfg := `{"mode":"include","paths":["` + strings.Join(manyPaths(MaxPathCount+1), `","`) + `"],"limits":{"maxPathCount":0,"maxDepth":0}}`
+	q, err := FromConfig(strings.NewReader(cfg))
+	if err != nil {
+		t.Fatalf("trusted config should be able to disable limits: %v", err)
+	}
+	if _, err := Shake(nestedArrays(MaxDepth+10), q); err != nil {
+		t.Errorf("maxDepth 0 should disable the depth limit: %v", err)
+	}
+}
+
+func TestFromConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  string
+	}{
+		{"malformed", `{"mode":"include",`},
+		{"invalid mode", `{"mode":"keep","paths":["$.a"]}`},
+		{"empty paths", `{"mode":"include","paths":[]}`},
+		{"invalid path", `{"mode":"include","paths":["$.a["]}`},
+		{"negative limit", `{"mode":"include","paths":["$.a"],"limits":{"maxPathCount":-1}}`},
+		{"wrong limit type", `{"mode":"include","paths":["$.a"],"limits":{"maxDepth":"deep"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := FromConfig(strings.NewReader(tt.cfg))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if msg := err.Error(); !strings.HasPrefix(msg, "shake config: ") || strings.Contains(msg, "shake request") {
+				t.Errorf("error %q should name the config, not a request", msg)
+			}
+		})
+	}
+}
+
+// applyMergePatch is the RFC 7386 MergePatch algorithm, used to check that
+// a generated patch really reproduces the shaken document.
+func applyMergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = applyMergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		q     Query
+		want  string
+	}{
+		{
+			name:  "nested object member",
+			input: `{"user":{"name":"John","password":"x"},"id":1}`,
+			q:     Exclude("$.user.password"),
+			want:  `{"user":{"password":null}}`,
+		},
+		{
+			name:  "recursive descent",
+			input: `{"a":{"secret":1,"keep":2},"b":{"c":{"secret":3}},"secret":4}`,
+			q:     Exclude("$..secret"),
+			want:  `{"a":{"secret":null},"b":{"c":{"secret":null}},"secret":null}`,
+		},
+		{
+			name:  "array element replaces whole array",
+			input: `{"tags":["a","b","c"],"n":1}`,
+			q:     Exclude("$.tags[1]"),
+			want:  `{"tags":["a","c"]}`,
+		},
+		{
+			name:  "member inside array element replaces whole array",
+			input: `{"users":[{"name":"A","token":"t"}]}`,
+			q:     Exclude("$.users[*].token"),
+			want:  `{"users":[{"name":"A"}]}`,
+		},
+		{
+			name:  "no match",
+			input: `{"name":"John"}`,
+			q:     Exclude("$.missing"),
+			want:  `{}`,
+		},
+		{
+			name:  "include",
+			input: `{"name":"John","age":30,"email":"j@x.com"}`,
+			q:     Include("$.name"),
+			want:  `{"age":null,"email":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := MergePatch([]byte(tt.input), tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("got  %s\nwant %s", patch, tt.want)
+			}
+
+			var doc, p any
+			json.Unmarshal([]byte(tt.input), &doc)
+			json.Unmarshal(patch, &p)
+			applied, _ := json.Marshal(applyMergePatch(doc, p))
+			shaken := MustShake([]byte(tt.input), tt.q)
+			if string(applied) != string(shaken) {
+				t.Errorf("applying patch gave %s, Shake gave %s", applied, shaken)
+			}
+		})
+	}
+}
+
+func TestMergePatchOptions(t *testing.T) {
+	patch, err := MergePatch([]byte("{\"a\":1, // keep\n\"b\":2,}"), Exclude("$.b"), WithJSONC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(patch) != `{"b":null}` {
+		t.Errorf("WithJSONC: got %s", patch)
+	}
+
+	var de *DuplicateKeyError
+	if _, err := MergePatch([]byte(`{"a":1,"a":2}`), Exclude("$.b"), WithRejectDuplicateKeys()); !errors.As(err, &de) {
+		t.Errorf("WithRejectDuplicateKeys: expected DuplicateKeyError, got %v", err)
+	}
+}
+
+func TestMergePatchInvalidPath(t *testing.T) {
+	if _, err := MergePatch([]byte(`{"a":1}`), Exclude("$.a[")); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestShakeMixedMultiSelector(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		q     Query
+		want  string
+	}{
+		{"include name on object", `{"a":1,"b":2,"0":3}`, Include("$['a', 0]"), `{"a":1}`},
+		{"include index on array", `[10,20,30]`, Include("$['a', 0]"), `[10]`},
+		{"exclude name on object", `{"a":1,"b":2,"0":3}`, Exclude("$['a', 0]"), `{"0":3,"b":2}`},
+		{"exclude index on array", `[10,20,30]`, Exclude("$['a', 0]"), `[20,30]`},
+		{"nested", `{"x":{"id":1,"v":2},"y":[5,6]}`, Include("$.*['id', 1]"), `{"x":{"id":1},"y":[6]}`},
+		{"with wildcard", `{"a":1,"b":2}`, Include("$['a', 0, *]"), `{"a":1,"b":2}`},
+		{"with wildcard on array", `[1,2]`, Include("$['a', 0, *]"), `[1,2]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Shake([]byte(tt.input), tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	input := []byte(`{
+		"user": {"name": "John", "address": {"city": "X", "zip": "1"}},
+		"orders": [{"id": 1, "items": [{"sku": "a"}, {"sku": "b", "name": "dup"}]}],
+		"tags": ["email", "phone"],
+		"empty": {},
+		"nothing": null
+	}`)
+
+	keys, err := KeySet(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"address", "city", "empty", "id", "items", "name", "nothing", "orders", "sku", "tags", "user", "zip"}
+	if !slices.Equal(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+func TestKeySetNoObjects(t *testing.T) {
+	for _, in := range []string{`[1,[2,"a"]]`, `"key"`, `42`, `[]`} {
+		keys, err := KeySet([]byte(in))
+		if err != nil {
+			t.Fatalf("%s: %v", in, err)
+		}
+		if len(keys) != 0 {
+			t.Errorf("%s: got %v, want no keys", in, keys)
+		}
+	}
+}
+
+func TestKeySetInvalidJSON(t *testing.T) {
+	for _, in := range []string{`{"a":1`, `{"a" 1}`, `[1,]`, ``} {
+		if _, err := KeySet([]byte(in)); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestKeySetMaxKeys(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := range 50 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `"k%d":{"shared":%d}`, i, i)
+	}
+	b.WriteString("}")
+	input := []byte(b.String())
+
+	var le *KeyLimitError
+	if _, err := KeySet(input, WithMaxKeys(50)); !errors.As(err, &le) || le.Limit != 50 {
+		t.Errorf("expected KeyLimitError{50}, got %v", err)
+	}
+
+	keys, err := KeySet(input, WithMaxKeys(51))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 51 {
+		t.Errorf("expected 51 keys, got %d", len(keys))
+	}
+
+	if _, err := KeySet(input, WithMaxKeys(0)); err != nil {
+		t.Errorf("0 should disable the cap, got %v", err)
+	}
+}
+
+func TestKeySetDefaultMaxKeys(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("[")
+	for i := range MaxDistinctKeys + 1 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"k%d":0}`, i)
+	}
+	b.WriteString("]")
+
+	var le *KeyLimitError
+	if _, err := KeySet([]byte(b.String())); !errors.As(err, &le) {
+		t.Errorf("expected KeyLimitError by default, got %v", err)
+	}
+}
+
+func TestShakeArrayOrderUnderOverlap(t *testing.T) {
+	input := []byte(`[10,20,30]`)
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{"slice and index", Include("$[0:2]", "$[1]"), `[10,20]`},
+		{"index and slice", Include("$[1]", "$[0:2]"), `[10,20]`},
+		{"wildcard and slice", Include("$[*]", "$[0:2]"), `[10,20,30]`},
+		{"indices out of order", Include("$[2]", "$[0]"), `[10,30]`},
+		{"negative and positive alias", Include("$[-1]", "$[2]"), `[30]`},
+		{"exclude overlap", Exclude("$[0:2]", "$[1]"), `[30]`},
+		{"exclude wildcard and index", Exclude("$[*]", "$[0]"), `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Shake(input, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeChanged(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		q       Query
+		changed bool
+	}{
+		{"exclude removes", `{"name":"a","password":"x"}`, Exclude("$..password"), true},
+		{"exclude no match", `{"name":"a","nested":{"k":1}}`, Exclude("$..password"), false},
+		{"formatting only", "{\n  \"b\": 1,\n  \"a\": 2.50\n}", Exclude("$.missing"), false},
+		{"include everything", `{"a":1,"b":[1,2]}`, Include("$.*"), false},
+		{"include subset", `{"a":1,"b":2}`, Include("$.a"), true},
+		{"array element", `[1,2,3]`, Exclude("$[1]"), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, changed, err := ShakeChanged([]byte(tt.input), tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if want := MustShake([]byte(tt.input), tt.q); string(out) != string(want) {
+				t.Errorf("output %s differs from Shake %s", out, want)
+			}
+		})
+	}
+}
+
+func TestShakeMerge(t *testing.T) {
+	inputs := [][]byte{
+		[]byte(`{"id":1,"name":"a","secret":"x"}`),
+		[]byte(`{"id":2,"name":"b"}`),
+		[]byte(`{"name":"c"}`),
+	}
+
+	out, err := ShakeMerge(inputs, Include("$.id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"id":1},{"id":2},{}]`; string(out) != want {
+		t.Errorf("got %s, want %s", out, want)
+	}
+
+	t.Run("no inputs", func(t *testing.T) {
+		out, err := ShakeMerge(nil, Include("$.id"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != `[]` {
+			t.Errorf("got %s, want []", out)
+		}
+	})
+
+	t.Run("invalid input", func(t *testing.T) {
+		_, err := ShakeMerge([][]byte{inputs[0], []byte(`{`)}, Include("$.id"))
+		if err == nil || !strings.Contains(err.Error(), "input 1") {
+			t.Errorf("err = %v, want it to name input 1", err)
+		}
+	})
+
+	t.Run("decoding options apply per input", func(t *testing.T) {
+		jsonc := [][]byte{[]byte("{\"id\":1, // first\n}"), []byte(`{"id":2,}`)}
+		out, err := ShakeMerge(jsonc, Include("$.id"), WithJSONC())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `[{"id":1},{"id":2}]`; string(out) != want {
+			t.Errorf("got %s, want %s", out, want)
+		}
+
+		dup := [][]byte{inputs[0], []byte(`{"id":1,"id":2}`)}
+		var de *DuplicateKeyError
+		if _, err := ShakeMerge(dup, Include("$.id"), WithRejectDuplicateKeys()); !errors.As(err, &de) {
+			t.Errorf("err = %v, want a DuplicateKeyError", err)
+		}
+	})
+
+	t.Run("skip empty", func(t *testing.T) {
+		mixed := [][]byte{inputs[0], []byte(`null`), inputs[2], []byte(`[]`), []byte(`{"id":3,"tags":[]}`)}
+		out, err := ShakeMerge(mixed, Include("$.id", "$.tags"), WithSkipEmpty())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `[{"id":1},{"id":3,"tags":[]}]`; string(out) != want {
+			t.Errorf("got %s, want %s", out, want)
+		}
+	})
+}
+
+func TestShakeExcludeLargeSubtree(t *testing.T) {
+	input := userDoc(1000)
+	for _, q := range []Query{Exclude("$.user"), Exclude("$.user", "$..missing"), Exclude("$..user")} {
+		out, err := Shake(input, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != `{"id":1}` {
+			t.Errorf("got %s", out)
+		}
+	}
+}
+
+func TestShakeWithIndent(t *testing.T) {
+	input := []byte(`{"name":"John","tags":["a","b"],"age":30}`)
+
+	out, err := Shake(input, Include("$.name", "$.tags"), WithIndent("", "  "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\n  \"name\": \"John\",\n  \"tags\": [\n    \"a\",\n    \"b\"\n  ]\n}"
+	if string(out) != want {
+		t.Errorf("got\n%s\nwant\n%s", out, want)
+	}
+
+	out, err = Shake(input, Include("$.age"), WithIndent("> ", "\t"), WithRawScalars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\n> \t\"age\": 30\n> }"; string(out) != want {
+		t.Errorf("got %q, want %q", out, want)
+	}
+}
+
+func TestShakeWithIndentEmptyResult(t *testing.T) {
+	tests := []struct{ input, want string }{
+		{`{"a":1}`, `{}`},
+		{`[1,2]`, `[]`},
+	}
+	for _, tt := range tests {
+		out, err := Shake([]byte(tt.input), Include("$.missing"), WithIndent("", "  "))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.input, out, tt.want)
+		}
+	}
+}
+
+func TestTruncateStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		maxLen int
+		input  string
+		want   string
+	}{
+		{"shorter", 10, `{"s":"short"}`, `{"s":"short"}`},
+		{"exact", 5, `{"s":"exact"}`, `{"s":"exact"}`},
+		{"longer", 4, `{"s":"truncated"}`, `{"s":"trun..."}`},
+		{"multibyte", 2, `{"s":"héllo"}`, `{"s":"hé..."}`},
+		{"emoji", 1, `{"s":"🌳🌲"}`, `{"s":"🌳..."}`},
+		{"zero", 0, `{"s":"abc","e":""}`, `{"e":"","s":"..."}`},
+		{"nested and arrays", 3, `{"a":{"b":["abcdef",1,null,"xy"]}}`, `{"a":{"b":["abc...",1,null,"xy"]}}`},
+		{"keys untouched", 1, `{"longkey":"value"}`, `{"longkey":"v..."}`},
+		{"numbers untouched", 1, `[12345,1.50]`, `[12345,1.50]`},
+		{"scalar root", 3, `"abcdef"`, `"abc..."`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := TruncateStrings(tt.maxLen, "...")([]byte(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateStringsErrors(t *testing.T) {
+	if _, err := TruncateStrings(3, "")([]byte(`{bad`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestTruncateStringsNegativeLengthPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic")
+		}
+	}()
+	TruncateStrings(-1, "")
+}
+
+func TestTruncateStringsAfterShake(t *testing.T) {
+	out := MustShake([]byte(`{"log":"0123456789","secret":"x"}`), Exclude("$.secret"))
+	out, err := TruncateStrings(4, "…")(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"log":"0123…"}` {
+		t.Errorf("got %s", out)
+	}
+}
+
+func TestDuplicatePathsCountOnce(t *testing.T) {
+	limits := Limits{MaxPathCount: Ptr(1)}
+
+	q, err := Include("$.a", "$.a", "$.a").WithLimits(limits).Compile()
+	if err != nil {
+		t.Fatalf("duplicates should count once towards MaxPathCount: %v", err)
+	}
+	out, err := Shake([]byte(`{"a":1,"b":2}`), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"a":1}` {
+		t.Errorf("got %s", out)
+	}
+
+	if _, err := Exclude("$.a", "$.b", "$.a").WithLimits(limits).Compile(); err == nil {
+		t.Error("expected distinct paths to exceed MaxPathCount")
+	}
+}
+
+func TestDedupeKeepsOrderAndInput(t *testing.T) {
+	in := []string{"$.b", "$.a", "$.b", ".a", "$.a"}
+	got := dedupe(in)
+	if want := []string{"$.b", "$.a", ".a"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if in[2] != "$.b" || len(in) != 5 {
+		t.Errorf("input slice was modified: %v", in)
+	}
+}
+
+func TestQueryUnderPrefix(t *testing.T) {
+	input := []byte(`{"data":{"name":"a","secret":"x","items":[{"id":1},{"id":2}]},"name":"top"}`)
+
+	tests := []struct {
+		name   string
+		under  Query
+		direct Query
+		want   string
+	}{
+		{
+			name:   "include",
+			under:  IncludeUnder("$.data", ".name"),
+			direct: Include("$.data.name"),
+			want:   `{"data":{"name":"a"}}`,
+		},
+		{
+			name:   "include bracket and absolute",
+			under:  IncludeUnder("$.data", "['items'][0].id", "$.name"),
+			direct: Include("$.data.items[0].id", "$.name"),
+			want:   `{"data":{"items":[{"id":1}]},"name":"top"}`,
+		},
+		{
+			name:   "exclude",
+			under:  ExcludeUnder("$.data", ".secret"),
+			direct: Exclude("$.data.secret"),
+			want:   `{"data":{"items":[{"id":1},{"id":2}],"name":"a"},"name":"top"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MustShake(input, tt.under)
+			if want := MustShake(input, tt.direct); string(got) != string(want) {
+				t.Errorf("under prefix %s, direct %s", got, want)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeDescendantMultiName(t *testing.T) {
+	input := []byte(`{"id":1,"name":"a","x":2,"child":{"id":3,"name":"b","y":4,"list":[{"id":5,"z":6},{"name":"c"}]}}`)
+
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{
+			name: "include",
+			q:    Include("$..['id','name']"),
+			want: `{"child":{"id":3,"list":[{"id":5},{"name":"c"}],"name":"b"},"id":1,"name":"a"}`,
+		},
+		{
+			name: "exclude",
+			q:    Exclude("$..['id','name']"),
+			want: `{"child":{"list":[{"z":6},{}],"y":4},"x":2}`,
+		},
+		{
+			name: "include equals separate paths",
+			q:    Include("$..id", "$..name"),
+			want: `{"child":{"id":3,"list":[{"id":5},{"name":"c"}],"name":"b"},"id":1,"name":"a"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Shake(input, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeDescendantNestedSameKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		path    string
+		include string
+		exclude string
+	}{
+		{
+			name:    "objects",
+			input:   `{"items":{"id":1,"x":0,"items":{"id":2,"x":0,"items":{"id":3}}}}`,
+			path:    "$..items.id",
+			include: `{"items":{"id":1,"items":{"id":2,"items":{"id":3}}}}`,
+			exclude: `{"items":{"items":{"items":{},"x":0},"x":0}}`,
+		},
+		{
+			name:    "arrays",
+			input:   `{"items":[{"id":1,"items":[{"id":2,"items":[{"id":3,"x":0}]}]}]}`,
+			path:    "$..items[*].id",
+			include: `{"items":[{"id":1,"items":[{"id":2,"items":[{"id":3}]}]}]}`,
+			exclude: `{"items":[{"items":[{"items":[{"x":0}]}]}]}`,
+		},
+		{
+			// Accepting the outer items keeps its whole subtree in include
+			// mode, and removes it, nested items included, in exclude mode.
+			name:    "container",
+			input:   `{"a":1,"items":{"items":{"items":2}}}`,
+			path:    "$..items",
+			include: `{"items":{"items":{"items":2}}}`,
+			exclude: `{"a":1}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MustShake([]byte(tt.input), Include(tt.path)); string(got) != tt.include {
+				t.Errorf("include: got %s, want %s", got, tt.include)
+			}
+			if got := MustShake([]byte(tt.input), Exclude(tt.path)); string(got) != tt.exclude {
+				t.Errorf("exclude: got %s, want %s", got, tt.exclude)
+			}
+		})
+	}
+}
+
+func TestShakeDescendantSlice(t *testing.T) {
+	input := []byte(`{"items":[1,2,3],"child":{"items":[4,5,6],"deeper":[{"items":[7,8,9]}]},"other":[10,11,12]}`)
+
+	tests := []struct {
+		name string
+		q    Query
+		want string
+	}{
+		{
+			name: "include slice",
+			q:    Include("$..items[0:2]"),
+			want: `{"child":{"deeper":[{"items":[7,8]}],"items":[4,5]},"items":[1,2]}`,
+		},
+		{
+			name: "exclude slice",
+			q:    Exclude("$..items[0:2]"),
+			want: `{"child":{"deeper":[{"items":[9]}],"items":[6]},"items":[3],"other":[10,11,12]}`,
+		},
+		{
+			name: "include multi-index",
+			q:    Include("$..items[0,2]"),
+			want: `{"child":{"deeper":[{"items":[7,9]}],"items":[4,6]},"items":[1,3]}`,
+		},
+		{
+			name: "exclude negative index",
+			q:    Exclude("$..items[-1]"),
+			want: `{"child":{"deeper":[{"items":[7,8]}],"items":[4,5]},"items":[1,2],"other":[10,11,12]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Shake(input, tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got  %s\nwant %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeDiff(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          string
+	}{
+		{"unchanged", `{"a":1,"b":{"c":2}}`, `{"b":{"c":2},"a":1}`, `{}`},
+		{"changed scalar", `{"a":1,"b":2}`, `{"a":1,"b":3}`, `{"b":3}`},
+		{"nested change", `{"u":{"name":"A","age":1}}`, `{"u":{"name":"A","age":2}}`, `{"u":{"age":2}}`},
+		{"added key", `{"a":1}`, `{"a":1,"b":{"c":1}}`, `{"b":{"c":1}}`},
+		{"removed key is not reported", `{"a":1,"b":2}`, `{"a":1}`, `{}`},
+		{"changed to null", `{"a":1}`, `{"a":null}`, `{"a":null}`},
+		{"type change", `{"a":{"x":1}}`, `{"a":[1]}`, `{"a":[1]}`},
+		{"array element changed", `{"l":[1,2,3],"k":1}`, `{"l":[1,5,3],"k":1}`, `{"l":[1,5,3]}`},
+		{"array length changed", `{"l":[1,2]}`, `{"l":[1,2,3]}`, `{"l":[1,2,3]}`},
+		{"array unchanged", `{"l":[{"a":1}]}`, `{"l":[{"a":1}]}`, `{}`},
+		{"large numbers", `{"id":9007199254740992}`, `{"id":9007199254740993}`, `{"id":9007199254740993}`},
+		{"root arrays equal", `[1,2]`, `[1,2]`, `[]`},
+		{"root arrays differ", `[1,2]`, `[2,1]`, `[2,1]`},
+		{"root scalar", `1`, `2`, `2`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := ShakeDiff([]byte(tt.before), []byte(tt.after))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.want {
+				t.Errorf("got %s, want %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeDiffScalarRoot(t *testing.T) {
+	out, err := ShakeDiff([]byte(`1`), []byte(`1`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != nil {
+		t.Errorf("unchanged scalar: got %q, want nil", out)
+	}
+
+	out, err = ShakeDiff([]byte(`1`), []byte(`null`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `null` {
+		t.Errorf("changed to null: got %q, want null", out)
+	}
+}
+
+func TestShakeDiffOptions(t *testing.T) {
+	out, err := ShakeDiff([]byte("{\"a\":1 /* old */}"), []byte("{\"a\":2,}"), WithJSONC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"a":2}` {
+		t.Errorf("WithJSONC: got %s", out)
+	}
+
+	var de *DuplicateKeyError
+	if _, err := ShakeDiff([]byte(`{}`), []byte(`{"a":1,"a":2}`), WithRejectDuplicateKeys()); !errors.As(err, &de) {
+		t.Errorf("WithRejectDuplicateKeys: expected DuplicateKeyError, got %v", err)
+	}
+}
+
+func TestShakeDiffInvalidJSON(t *testing.T) {
+	if _, err := ShakeDiff([]byte(`{`), []byte(`{}`)); err == nil {
+		t.Error("expected error for invalid before")
+	}
+	if _, err := ShakeDiff([]byte(`{}`), []byte(`{`)); err == nil {
+		t.Error("expected error for invalid after")
+	}
+}
+
+func TestShakeWithPatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		q     Query
+		want  string
+	}{
+		{
+			name:  "nested object",
+			input: `{"user":{"name":"a","password":"x"},"id":1}`,
+			q:     Exclude("$.user.password"),
+			want:  `[{"op":"remove","path":"/user/password"}]`,
+		},
+		{
+			name:  "inside array elements",
+			input: `{"users":[{"n":1,"pw":"x"},{"n":2,"pw":"y"}]}`,
+			q:     Exclude("$..pw"),
+			want:  `[{"op":"remove","path":"/users/0/pw"},{"op":"remove","path":"/users/1/pw"}]`,
+		},
+		{
+			name:  "array element removed",
+			input: `{"tags":["a","b","c"],"x":1}`,
+			q:     Exclude("$.tags[1]"),
+			want:  `[{"op":"remove","path":"/tags/1"}]`,
+		},
+		{
+			name:  "array elements removed in descending order",
+			input: `{"items":[{"id":0},{"id":1},{"id":2},{"id":3}]}`,
+			q:     Exclude("$.items[0]", "$.items[2]"),
+			want:  `[{"op":"remove","path":"/items/2"},{"op":"remove","path":"/items/0"}]`,
+		},
+		{
+			name:  "duplicate array elements",
+			input: `{"l":[1,1,2]}`,
+			q:     Exclude("$.l[1]"),
+			want:  `[{"op":"remove","path":"/l/1"}]`,
+		},
+		{
+			name:  "array elements dropped and modified",
+			input: `{"l":[{"a":1,"x":1},{"a":2,"x":2}]}`,
+			q:     Exclude("$.l[0]", "$.l[*].x"),
+			want:  `[{"op":"replace","path":"/l","value":[{"a":2}]}]`,
+		},
+		{
+			name:  "root array",
+			input: `[{"id":1,"pw":"x"},{"id":2}]`,
+			q:     Exclude("$[*].pw"),
+			want:  `[{"op":"remove","path":"/0/pw"}]`,
+		},
+		{
+			name:  "pointer escaping",
+			input: `{"a/b":1,"c~d":2,"~1":3,"e":4}`,
+			q:     Exclude("$['a/b']", "$['c~d']", "$['~1']"),
+			want:  `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/c~0d"},{"op":"remove","path":"/~01"}]`,
+		},
+		{
+			name:  "include",
+			input: `{"a":1,"b":{"c":2,"d":3}}`,
+			q:     Include("$.b.c"),
+			want:  `[{"op":"remove","path":"/a"},{"op":"remove","path":"/b/d"}]`,
+		},
+		{
+			name:  "unchanged",
+			input: `{"a":1}`,
+			q:     Exclude("$.missing"),
+			want:  `[]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, patch, err := ShakeWithPatch([]byte(tt.input), tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("patch %s, want %s", patch, tt.want)
+			}
+			if want := MustShake([]byte(tt.input), tt.q); string(out) != string(want) {
+				t.Errorf("result %s differs from Shake %s", out, want)
+			}
+		})
+	}
+}
+
+func TestShakeWithPatchOptions(t *testing.T) {
+	input := []byte(`{"a":1.50,"b":"<x>", // note
+}`)
+	out, patch, err := ShakeWithPatch(input, Exclude("$.a"), WithJSONC(), WithRawScalars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"b":"<x>"}` {
+		t.Errorf("result %s", out)
+	}
+	if string(patch) != `[{"op":"remove","path":"/a"}]` {
+		t.Errorf("patch %s", patch)
+	}
+
+	// Values carried by operations keep their original bytes too.
+	_, patch, err = ShakeWithPatch([]byte(`{"a":[{"x":1,"y":2},1.50,"<x>",4]}`), Exclude("$.a[0].x", "$.a[3]"), WithRawScalars())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `[{"op":"replace","path":"/a","value":[{"y":2},1.50,"<x>"]}]`; string(patch) != want {
+		t.Errorf("raw patch %s, want %s", patch, want)
+	}
+
+	_, patch, err = ShakeWithPatch([]byte(`{"a":1,"b":2}`), Exclude("$.b"), WithIndent("", " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[\n {\n  \"op\": \"remove\",\n  \"path\": \"/b\"\n }\n]"; string(patch) != want {
+		t.Errorf("indented patch %s, want %s", patch, want)
+	}
+
+	var de *DuplicateKeyError
+	if _, _, err := ShakeWithPatch([]byte(`{"a":1,"a":2}`), Exclude("$.b"), WithRejectDuplicateKeys()); !errors.As(err, &de) {
+		t.Errorf("WithRejectDuplicateKeys: expected DuplicateKeyError, got %v", err)
+	}
+}
+
+func TestShakeValueCycle(t *testing.T) {
+	self := map[string]any{"name": "a"}
+	self["self"] = self
+
+	deep := map[string]any{}
+	deep["child"] = map[string]any{"list": []any{1, deep}}
+
+	loop := []any{1, nil}
+	loop[1] = loop
+
+	w, err := NewWalker(Exclude("$..missing"), WithCycleDetection())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tree := range map[string]any{"self": self, "deep": deep, "slice": loop} {
+		if _, err := ShakeValue(tree, Exclude("$..missing"), WithCycleDetection()); !errors.Is(err, ErrCycle) {
+			t.Errorf("ShakeValue %s: expected ErrCycle, got %v", name, err)
+		}
+		if _, err := w.Tree(tree); !errors.Is(err, ErrCycle) {
+			t.Errorf("Walker.Tree %s: expected ErrCycle, got %v", name, err)
+		}
+	}
+
+	// A subtree shared by siblings is not a cycle.
+	shared := map[string]any{"v": 1}
+	list := []any{1, 2}
+	dag := map[string]any{"a": shared, "b": shared, "l1": list, "l2": list, "l3": list[:1]}
+	got, err := ShakeValue(dag, Include("$.a", "$.b.v", "$.l1", "$.l3"), WithCycleDetection())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{"a": map[string]any{"v": 1}, "b": map[string]any{"v": 1}, "l1": []any{1, 2}, "l3": []any{1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+
+	// Below MaxDepth the pass stops and the walker's depth limit decides.
+	var tooDeep any = map[string]any{}
+	for range MaxDepth + 10 {
+		tooDeep = []any{tooDeep}
+	}
+	var de *DepthError
+	if _, err := ShakeValue(tooDeep, Exclude("$..missing"), WithCycleDetection()); !errors.As(err, &de) {
+		t.Errorf("deep acyclic tree: expected DepthError, got %v", err)
+	}
+}
+
+func TestShakeValue(t *testing.T) {
+	tree := func() map[string]any {
+		return map[string]any{
+			"id":   json.Number("9007199254740993"),
+			"user": map[string]any{"name": "a", "password": "x"},
+			"tags": []any{"p", "q"},
+		}
+	}
+
+	t.Run("include", func(t *testing.T) {
+		in := tree()
+		got, err := ShakeValue(in, Include("$.id", "$.user.name"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{
+			"id":   json.Number("9007199254740993"),
+			"user": map[string]any{"name": "a"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+		if !reflect.DeepEqual(in, tree()) {
+			t.Errorf("input modified: %#v", in)
+		}
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		in := tree()
+		got, err := ShakeValue(in, Exclude("$..password", "$.tags[0]"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{
+			"id":   json.Number("9007199254740993"),
+			"user": map[string]any{"name": "a"},
+			"tags": []any{"q"},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+		if !reflect.DeepEqual(in, tree()) {
+			t.Errorf("input modified: %#v", in)
+		}
+	})
+
+	t.Run("include no match", func(t *testing.T) {
+		got, err := ShakeValue(tree(), Include("$.missing"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, map[string]any{}) {
+			t.Errorf("got %#v, want empty map", got)
+		}
+	})
+}
+
+func TestShakeScalarRoot(t *testing.T) {
+	for _, scalar := range []string{`5`, `-1.50`, `"hi"`, `true`, `false`} {
+		t.Run(scalar, func(t *testing.T) {
+			tests := []struct {
+				name string
+				q    Query
+				want string
+			}{
+				{"include path", Include("$.a"), `null`},
+				{"include index", Include("$[0]"), `null`},
+				{"include root", Include("$"), scalar},
+				{"exclude path", Exclude("$.a", "$..b"), scalar},
+				{"exclude root", Exclude("$"), `null`},
+			}
+			for _, tt := range tests {
+				out, err := Shake([]byte(scalar), tt.q)
+				if err != nil {
+					t.Fatalf("%s: %v", tt.name, err)
+				}
+				if string(out) != tt.want {
+					t.Errorf("%s: got %s, want %s", tt.name, out, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWalker(t *testing.T) {
+	w, err := NewWalker(Exclude("$..password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("bytes", func(t *testing.T) {
+		out, err := w.Bytes([]byte(`{"name":"a","password":"x"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != `{"name":"a"}` {
+			t.Errorf("got %s", out)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		in := strings.NewReader("{\"a\":1,\"password\":1}\n{\"b\":{\"password\":2}}\n\n[{\"password\":3}]")
+		var out bytes.Buffer
+		if err := w.Stream(in, &out); err != nil {
+			t.Fatal(err)
+		}
+		if want := "{\"a\":1}\n{\"b\":{}}\n[{}]\n"; out.String() != want {
+			t.Errorf("got %q, want %q", out.String(), want)
+		}
+	})
+
+	t.Run("stream error", func(t *testing.T) {
+		var out bytes.Buffer
+		if err := w.Stream(strings.NewReader(`{"a":1} {bad`), &out); err == nil {
+			t.Error("expected error")
+		}
+		if out.String() != "{\"a\":1}\n" {
+			t.Errorf("documents before the error should be written, got %q", out.String())
+		}
+	})
+
+	t.Run("tree", func(t *testing.T) {
+		tree := map[string]any{"name": "a", "password": "x", "n": json.Number("1")}
+		got, err := w.Tree(tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]any{"name": "a", "n": json.Number("1")}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if _, ok := tree["password"]; !ok {
+			t.Error("input tree was modified")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := range 8 {
+			wg.Go(func() {
+				in := fmt.Appendf(nil, `{"i":%d,"password":"x"}`, i)
+				out, err := w.Bytes(in)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if want := fmt.Sprintf(`{"i":%d}`, i); string(out) != want {
+					t.Errorf("got %s, want %s", out, want)
+				}
+			})
+		}
+		wg.Wait()
+	})
+}
+
+func TestWalkerOptions(t *testing.T) {
+	w, err := NewWalker(Include("$.n"), WithRawScalars(), WithIndent("", " "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := w.Bytes([]byte(`{"n":1.50,"m":2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != "{\n \"n\": 1.50\n}" {
+		t.Errorf("got %q", out)
+	}
+}
+
+func TestWalkerStreamJSONC(t *testing.T) {
+	w, err := NewWalker(Exclude("$..password"), WithJSONC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := strings.NewReader(`// first
+{"a": 1, "password": "x",} /* between { "b": 2 } */
+{"b": [1, 2,], // trailing
+}
+`)
+	var out bytes.Buffer
+	if err := w.Stream(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"a\":1}\n{\"b\":[1,2]}\n"; out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if err := w.Stream(strings.NewReader(`{"a":1} /* open`), &out); err == nil {
+		t.Error("expected error for unterminated comment")
+	}
+}
+
+func TestNewWalkerInvalidPath(t *testing.T) {
+	var pe *ParseError
+	if _, err := NewWalker(Include("$.a[")); !errors.As(err, &pe) {
+		t.Errorf("expected ParseError, got %v", err)
+	}
+}
+
+func TestShakeElements(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		q     Query
+		want  string
+	}{
+		{
+			name:  "include",
+			input: `[{"id":1,"name":"a","secret":"x"}, {"id":2,"name":"b"}, {"other":3}]`,
+			q:     Include("$.id", "$.name"),
+			want:  `[{"id":1,"name":"a"},{"id":2,"name":"b"},{}]`,
+		},
+		{
+			name:  "exclude",
+			input: `[{"id":1,"secret":"x"},{"nested":{"secret":"y"}}]`,
+			q:     Exclude("$..secret"),
+			want:  `[{"id":1},{"nested":{}}]`,
+		},
+		{
+			// "$" is each element, so "$[0]" is the first item of every
+			// nested array, not the first element of the stream.
+			name:  "dollar is the element",
+			input: `[[1,2,3],[4,5]]`,
+			q:     Exclude("$[0]"),
+			want:  `[[2,3],[5]]`,
+		},
+		{
+			name:  "scalar elements",
+			input: `["s",{"a":1},2]`,
+			q:     Include("$.a"),
+			want:  `[null,{"a":1},null]`,
+		},
+		{name: "empty", input: ` [ ] `, q: Include("$.id"), want: `[]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := ShakeElements(strings.NewReader(tt.input), &out, tt.q); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got %s, want %s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestShakeElementsMatchesWildcardShake(t *testing.T) {
+	input := `[{"id":1,"name":"a","secret":"x"},{"id":2,"tags":["t"]}]`
+
+	var out bytes.Buffer
+	if err := ShakeElements(strings.NewReader(input), &out, Include("$.id", "$.tags")); err != nil {
+		t.Fatal(err)
+	}
+	want := MustShake([]byte(input), Include("$[*].id", "$[*].tags"))
+	if out.String() != string(want) {
+		t.Errorf("ShakeElements %s, Shake with [*] %s", out.String(), want)
+	}
+}
+
+func TestShakeElementsErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"object root", `{"a":1}`},
+		{"scalar root", `42`},
+		{"truncated", `[{"a":1},`},
+		{"invalid element", `[{"a":1},{"a"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := ShakeElements(strings.NewReader(tt.input), &out, Include("$.a")); err == nil {
+				t.Errorf("expected error, wrote %s", out.String())
+			}
+		})
+	}
+
+	var out bytes.Buffer
+	if err := ShakeElements(strings.NewReader(`{}`), &out, Include("$.a")); err == nil || out.Len() != 0 {
+		t.Errorf("non-array root: err = %v, wrote %q", err, out.String())
+	}
+
+	out.Reset()
+	err := ShakeElements(strings.NewReader(`[{"a":1}]`), &out, Include("$.a"), WithIndent("", "  "))
+	if !errors.Is(err, ErrUnsupportedOption) || out.Len() != 0 {
+		t.Errorf("WithIndent: err = %v, wrote %q", err, out.String())
+	}
+
+	out.Reset()
+	err = ShakeElements(strings.NewReader(`[{"a":1}, // c
+	]`), &out, Include("$.a"), WithJSONC())
+	if !errors.Is(err, ErrUnsupportedOption) || out.Len() != 0 {
+		t.Errorf("WithJSONC: err = %v, wrote %q", err, out.String())
+	}
+}
+
+func TestShakeNegativeIndex(t *testing.T) {
+	tests := []struct {
+		input   string
+		path    string
+		include string
+		exclude string
+	}{
+		{`[]`, "$[-1]", `[]`, `[]`},
+		{`[1]`, "$[-1]", `[1]`, `[]`},
+		{`[1,2]`, "$[-1]", `[2]`, `[1]`},
+		{`[1,2,3]`, "$[-1]", `[3]`, `[1,2]`},
+		{`[1,2,3]`, "$[-3]", `[1]`, `[2,3]`},
+		{`[1,2]`, "$[-3]", `[]`, `[1,2]`},
+		{`[1]`, "$[-2]", `[]`, `[1]`},
+		{`{"a":[],"b":[7],"c":[7,8]}`, "$.*[-1]", `{"b":[7],"c":[8]}`, `{"a":[],"b":[],"c":[7]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input+tt.path, func(t *testing.T) {
+			out, err := Shake([]byte(tt.input), Include(tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.include {
+				t.Errorf("include: got %s, want %s", out, tt.include)
+			}
+
+			out, err = Shake([]byte(tt.input), Exclude(tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.exclude {
+				t.Errorf("exclude: got %s, want %s", out, tt.exclude)
+			}
+		})
+	}
+}
+
+func TestShakeSortedKeys(t *testing.T) {
+	a := []byte(`{"z":{"b":1,"a":[{"y":1,"x":2}]},"m":"s","a":0,"secret":1}`)
+	b := []byte("{\n\t\"secret\": 1,\n\t\"a\": 0,\n\t\"m\": \"s\",\n\t\"z\": {\"a\": [{\"x\": 2, \"y\": 1}], \"b\": 1}\n}")
+	want := `{"a":0,"m":"s","z":{"a":[{"x":2,"y":1}],"b":1}}`
+
+	for _, opts := range [][]ShakeOption{nil, {WithRawScalars()}} {
+		for _, q := range []Query{Exclude("$.secret"), Include("$.a", "$.m", "$.z")} {
+			outA := MustShake(a, q, opts...)
+			outB := MustShake(b, q, opts...)
+			if string(outA) != want || string(outB) != want {
+				t.Errorf("got\n%s\n%s\nwant %s", outA, outB, want)
+			}
+		}
+	}
+
+	// Key order and whitespace are normalized; number spelling is not.
+	one := MustShake([]byte(`{"n":1}`), Exclude("$.x"))
+	oneDotZero := MustShake([]byte(`{"n":1.0}`), Exclude("$.x"))
+	if string(one) == string(oneDotZero) {
+		t.Errorf("1 and 1.0 both shook to %s; numbers should be kept as written", one)
+	}
+}
@@ -0,0 +1,64 @@
+package shaker
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Transform rewrites a JSON document. Like [Shake] it takes and returns
+// JSON bytes, so transforms chain with shakes in either order.
+type Transform func(input []byte) ([]byte, error)
+
+// TruncateStrings returns a [Transform] that shortens every string value
+// longer than maxLen runes to its first maxLen runes followed by suffix.
+// Object keys are left alone, and multibyte characters are never split.
+//
+// It suits log sanitisation, where any field may carry an oversized blob:
+//
+//	out, err := shaker.TruncateStrings(256, "…")(payload)
+//
+// The length is fixed by the caller rather than read from input, so a
+// negative maxLen is a programming error: TruncateStrings panics, as
+// [strings.Repeat] does for a negative count.
+func TruncateStrings(maxLen int, suffix string) Transform {
+	if maxLen < 0 {
+		panic(fmt.Sprintf("shaker: truncate length must not be negative, got %d", maxLen))
+	}
+
+	return func(input []byte) ([]byte, error) {
+		tree, err := shakeConfig{}.decode(input)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(truncateStrings(tree, maxLen, suffix))
+	}
+}
+
+// truncateStrings rewrites v in place; the tree is freshly decoded and
+// owned by the caller.
+func truncateStrings(v any, maxLen int, suffix string) any {
+	switch v := v.(type) {
+	case string:
+		return truncateString(v, maxLen, suffix)
+	case map[string]any:
+		for k, child := range v {
+			v[k] = truncateStrings(child, maxLen, suffix)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = truncateStrings(child, maxLen, suffix)
+		}
+	}
+	return v
+}
+
+func truncateString(s string, maxLen int, suffix string) string {
+	n := 0
+	for i := range s {
+		if n == maxLen {
+			return s[:i] + suffix
+		}
+		n++
+	}
+	return s
+}
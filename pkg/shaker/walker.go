@@ -0,0 +1,159 @@
+package shaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Walker applies one compiled [Query] to many documents with the same
+// [ShakeOption]s, so a hot path pays only for decoding and encoding.
+//
+// A Walker is immutable and safe for concurrent use, like the compiled
+// Query it holds.
+type Walker struct {
+	q   Query
+	cfg shakeConfig
+}
+
+// NewWalker compiles q and returns a [Walker] for it. Compilation errors are
+// reported here rather than on the first document.
+func NewWalker(q Query, opts ...ShakeOption) (*Walker, error) {
+	compiled, err := q.Compile()
+	if err != nil {
+		return nil, err
+	}
+	return &Walker{q: compiled, cfg: newShakeConfig(opts)}, nil
+}
+
+// Bytes shakes one JSON document; it is [Shake] with the walker's query and
+// options.
+func (w *Walker) Bytes(input []byte) ([]byte, error) {
+	_, result, err := walk(input, w.q, w.cfg)
+	if err != nil {
+		return nil, err
+	}
+	return w.cfg.marshal(result)
+}
+
+// Stream shakes every JSON document read from r — a single document, or a
+// sequence such as newline-delimited JSON — and writes each result to out
+// followed by a newline. It stops at the first error.
+//
+// With [WithJSONC], r is read in full and its comments are removed before
+// the documents are split apart, since a comment may hide anything that
+// looks like a document boundary.
+func (w *Walker) Stream(r io.Reader, out io.Writer) error {
+	if w.cfg.jsonc {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if data, err = stripJSONC(data); err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var doc json.RawMessage
+		if err := dec.Decode(&doc); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		shaken, err := w.Bytes(doc)
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(append(shaken, '\n')); err != nil {
+			return err
+		}
+	}
+}
+
+// Tree shakes an already-decoded document without any JSON encoding. The
+// tree should use the shapes [encoding/json] produces (map[string]any,
+// []any, json.Number, …) and is not modified. With [WithCycleDetection],
+// a cyclic tree is rejected with [ErrCycle], as by [ShakeValue].
+func (w *Walker) Tree(tree any) (any, error) {
+	return walkValue(tree, w.q, w.cfg)
+}
+
+// ErrUnsupportedOption is returned, wrapped with the option's name, by
+// entry points that cannot honour a [ShakeOption] they were given.
+var ErrUnsupportedOption = errors.New("shaker: option not supported")
+
+// ShakeElements shakes each element of a root array as a document of its
+// own, without holding the whole array in memory: every element is
+// decoded, shaken and written to w as soon as it is read, so memory is
+// bounded by the largest element.
+//
+// Unlike [Shake], "$" here is each element, not the array. "$.id" selects
+// the id of every element, as "$[*].id" would with [Shake], and selectors
+// on the array itself, such as "$[0:10]", cannot be expressed. Every
+// element yields one entry, in order: an element whose contents were all
+// pruned appears as {} or [], and a scalar element that include mode does
+// not keep appears as null rather than being dropped.
+//
+// Only array roots are supported; any other root is an error, reported
+// before anything is written. [WithIndent], which cannot indent the outer
+// array, and [WithJSONC], which needs the whole input to find comments,
+// are rejected with [ErrUnsupportedOption]; other options apply to each
+// element.
+//
+//	err := shaker.ShakeElements(resp.Body, w, shaker.Include("$.id", "$.name"))
+func ShakeElements(r io.Reader, w io.Writer, q Query, opts ...ShakeOption) error {
+	sw, err := NewWalker(q, opts...)
+	if err != nil {
+		return err
+	}
+	switch {
+	case sw.cfg.indented:
+		return fmt.Errorf("%w: WithIndent in ShakeElements", ErrUnsupportedOption)
+	case sw.cfg.jsonc:
+		return fmt.Errorf("%w: WithJSONC in ShakeElements", ErrUnsupportedOption)
+	}
+
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != json.Delim('[') {
+		return errors.New("shaker: ShakeElements requires an array root")
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := 0; dec.More(); i++ {
+		var elem json.RawMessage
+		if err := dec.Decode(&elem); err != nil {
+			return err
+		}
+
+		shaken, err := sw.Bytes(elem)
+		if err != nil {
+			return fmt.Errorf("shaker: element %d: %w", i, err)
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(shaken); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]")
+	return err
+}